@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/johananl/follower-maze"
+	"github.com/johananl/follower-maze/tlsutil"
+	"github.com/johananl/follower-maze/userclients"
+)
+
+// Command-line flags
+var (
+	eventCert     = flag.String("event-tls-cert", "", "TLS certificate file for the event listeners")
+	eventKey      = flag.String("event-tls-key", "", "TLS key file for the event listeners")
+	eventClientCA = flag.String("event-tls-client-ca", "", "CA file for verifying event source client certificates")
+	userCert      = flag.String("user-tls-cert", "", "TLS certificate file for the user listeners")
+	userKey       = flag.String("user-tls-key", "", "TLS key file for the user listeners")
+	authSecret    = flag.String("auth-hmac-secret", "", "Shared secret for authenticating user clients with HMAC tokens")
+	authTokenFile = flag.String("auth-token-file", "", "File with static tokens for authenticating user clients")
+	recordFile    = flag.String("record-events", "", "File to record the event source traffic to")
+	replayFile    = flag.String("replay-events", "", "File with recorded event source traffic to replay")
+	replaySpeed   = flag.Float64("replay-speed", 1, "Speed of replay relative to the recording, or 0 for as fast as possible")
+	replayDelay   = flag.Duration("replay-delay", 5*time.Second, "Time to wait for user clients to connect before replaying")
+	webhookURL    = flag.String("webhook-url", "", "URL to POST notifications of disconnected users to")
+	webhookSecret = flag.String("webhook-secret", "", "Secret for signing webhook requests")
+)
+
+// tlsConfig builds a TLS config from the given files. It returns a nil config if no certificate
+// was given. The certificate's reloader is appended to reloaders so that it can be reloaded later.
+func tlsConfig(certFile, keyFile, clientCAFile string, reloaders *[]*tlsutil.CertReloader) *tls.Config {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			log.Fatal("A client CA requires a TLS certificate and key")
+		}
+		return nil
+	}
+
+	cr, err := tlsutil.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatal("Error loading TLS certificate: ", err)
+	}
+	config, err := tlsutil.NewServerConfig(cr, clientCAFile)
+	if err != nil {
+		log.Fatal("Error creating TLS config: ", err)
+	}
+	*reloaders = append(*reloaders, cr)
+
+	return config
+}
+
+func main() {
+	flag.Parse()
+
+	// Set logging
+	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
+
+	// Always serve HTTP event sources and user clients
+	opts := []followermaze.Option{followermaze.WithHTTP()}
+
+	// Configure TLS
+	var reloaders []*tlsutil.CertReloader
+	if config := tlsConfig(*eventCert, *eventKey, *eventClientCA, &reloaders); config != nil {
+		opts = append(opts, followermaze.WithEventTLS(config))
+	}
+	if config := tlsConfig(*userCert, *userKey, "", &reloaders); config != nil {
+		opts = append(opts, followermaze.WithUserTLS(config))
+	}
+
+	// Configure user authentication
+	switch {
+	case *authSecret != "" && *authTokenFile != "":
+		log.Fatal("Only one of -auth-hmac-secret and -auth-token-file may be set")
+	case *authSecret != "":
+		opts = append(opts, followermaze.WithAuthenticator(userclients.NewHMACAuthenticator([]byte(*authSecret))))
+	case *authTokenFile != "":
+		a, err := userclients.NewTokenFileAuthenticator(*authTokenFile)
+		if err != nil {
+			log.Fatal("Error loading token file: ", err)
+		}
+		opts = append(opts, followermaze.WithAuthenticator(a))
+	}
+
+	// Record event source traffic
+	if *recordFile != "" {
+		f, err := os.Create(*recordFile)
+		if err != nil {
+			log.Fatal("Error creating recording file: ", err)
+		}
+		defer f.Close()
+		opts = append(opts, followermaze.WithRecorder(f))
+	}
+
+	// Send notifications of disconnected users to a webhook
+	if *webhookURL != "" {
+		opts = append(opts, followermaze.WithWebhook(userclients.WebhookConfig{
+			URL:    *webhookURL,
+			Secret: []byte(*webhookSecret),
+		}))
+	}
+
+	s, err := followermaze.New(opts...)
+	if err != nil {
+		log.Fatal("Error configuring server: ", err)
+	}
+
+	// Reload TLS certificates on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Println("SIGHUP received - reloading TLS certificates")
+			for _, cr := range reloaders {
+				if err := cr.Reload(); err != nil {
+					log.Println("Error reloading TLS certificate:", err.Error())
+				}
+			}
+		}
+	}()
+
+	// Replay recorded event source traffic once user clients had time to connect
+	if *replayFile != "" {
+		f, err := os.Open(*replayFile)
+		if err != nil {
+			log.Fatal("Error opening replay file: ", err)
+		}
+		defer f.Close()
+		go func() {
+			time.Sleep(*replayDelay)
+			log.Println("Replaying event source traffic from " + *replayFile)
+			if err := s.Replay(f, *replaySpeed); err != nil {
+				log.Println("Error replaying event source traffic:", err.Error())
+				return
+			}
+			log.Println("Replay complete")
+		}()
+	}
+
+	// Listen for SIGINT and shutdown gracefully
+	// TODO Handle SIGTERM too
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt)
+	go func() {
+		<-shutdown
+		log.Println("SIGINT received - shutting down")
+		cancel()
+	}()
+
+	// Block until the server is stopped
+	if err := s.Run(ctx); err != nil {
+		log.Fatal("Error running server: ", err)
+	}
+
+	log.Println("Graceful shutdown complete")
+}
@@ -0,0 +1,95 @@
+// Command mazebench runs the benchmark suite and writes the results in the standard Go benchmark
+// format, so that results of different revisions can be compared with benchstat:
+//
+//	go run ./cmd/mazebench -o old.txt
+//	(make changes)
+//	go run ./cmd/mazebench -o new.txt
+//	benchstat old.txt new.txt
+//
+// Results are preceded by configuration lines recording the revision, date and Go version they
+// were taken with.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command-line flags
+var (
+	bench  = flag.String("bench", ".", "Regular expression selecting the benchmarks to run")
+	count  = flag.Int("count", 5, "Number of times to run every benchmark")
+	output = flag.String("o", "", "File to write the results to (default standard output)")
+)
+
+// packages holds the packages with benchmarks.
+var packages = []string{"./events", "./userclients", "./mazetest"}
+
+// resultPrefixes are the prefixes of lines which belong to the benchmark format. Anything else,
+// such as log output, is dropped.
+var resultPrefixes = []string{"Benchmark", "goos:", "goarch:", "pkg:", "cpu:"}
+
+// revision returns the current git revision, or "unknown" if it can't be determined.
+func revision() string {
+	out, err := exec.Command("git", "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// writeResults copies the lines of go test output which belong to the benchmark format to w.
+func writeResults(w io.Writer, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		for _, p := range resultPrefixes {
+			if strings.HasPrefix(s.Text(), p) {
+				fmt.Fprintln(w, s.Text())
+				break
+			}
+		}
+	}
+
+	return s.Err()
+}
+
+func main() {
+	flag.Parse()
+
+	args := append([]string{"test", "-run", "^$", "-bench", *bench, "-benchmem", "-count", strconv.Itoa(*count)}, packages...)
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		os.Stderr.Write(out)
+		log.Fatal("Error running benchmarks: ", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("Error creating output file: ", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	fmt.Fprintln(w, "commit:", revision())
+	fmt.Fprintln(w, "date:", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintln(w, "go:", runtime.Version())
+	if err := writeResults(w, bytes.NewReader(out)); err != nil {
+		log.Fatal("Error writing results: ", err)
+	}
+}
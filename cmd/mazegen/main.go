@@ -0,0 +1,94 @@
+// Command mazegen is a load generator which emulates the followermaze test harness without
+// requiring a JVM. It sends a random stream of events to a running server and verifies that the
+// connected user clients receive exactly the expected notifications, in order. Runs with the same
+// seed are reproducible.
+//
+// With -verify, user clients record all notifications and every failing client reports its
+// missing, extra and out-of-order notifications by sequence. The expected notifications assume a
+// fresh server, so the server must be restarted between runs: the follows of an earlier run would
+// otherwise show up as extra status update notifications. With -events, a recorded stream of
+// events is sent instead of random events. It may hold one event per line or be a recording written
+// by the server's -record-events flag.
+//
+// Every setting may be given as a flag or, like with the original harness, as an environment
+// variable of the same name. Flags take precedence.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/johananl/follower-maze/harness"
+)
+
+// maxDiscrepancies limits the number of discrepancies printed per user client.
+const maxDiscrepancies = 20
+
+// envInt returns the integer value of an environment variable, or def if it isn't set or invalid.
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+func main() {
+	c := harness.DefaultConfig()
+
+	eventPort := flag.Int("eventListenerPort", envInt("eventListenerPort", 9090), "Port of the server's event listener")
+	clientPort := flag.Int("clientListenerPort", envInt("clientListenerPort", 9099), "Port of the server's user client listener")
+	flag.IntVar(&c.TotalEvents, "totalEvents", envInt("totalEvents", c.TotalEvents), "Number of events to send")
+	flag.IntVar(&c.ConcurrencyLevel, "concurrencyLevel", envInt("concurrencyLevel", c.ConcurrencyLevel), "Number of connected users")
+	numberOfUsers := flag.Int("numberOfUsers", envInt("numberOfUsers", 0), "Total number of users (default concurrencyLevel * 10)")
+	seed := flag.Int64("randomSeed", int64(envInt("randomSeed", int(c.RandomSeed))), "Seed for generating random values")
+	timeout := flag.Int("timeout", envInt("timeout", int(c.Timeout/time.Millisecond)), "Timeout in milliseconds for clients waiting for notifications")
+	flag.IntVar(&c.MaxEventSourceBatchSize, "maxEventSourceBatchSize", envInt("maxEventSourceBatchSize", c.MaxEventSourceBatchSize), "Maximum number of events shuffled and sent together")
+	verify := flag.Bool("verify", false, "Record all notifications and report every discrepancy. The server must be fresh: restart it between runs, since follows left by an earlier run are reported as extra notifications")
+	eventsFile := flag.String("events", "", "File with a recorded stream of events, one per line or as written by -record-events, to send instead of random ones")
+	flag.Parse()
+
+	log.SetFlags(log.Lmicroseconds)
+
+	c.EventAddr = "localhost:" + strconv.Itoa(*eventPort)
+	c.ClientAddr = "localhost:" + strconv.Itoa(*clientPort)
+	c.NumberOfUsers = *numberOfUsers
+	if c.NumberOfUsers == 0 {
+		c.NumberOfUsers = c.ConcurrencyLevel * 10
+	}
+	c.RandomSeed = *seed
+	c.Timeout = time.Duration(*timeout) * time.Millisecond
+	c.Verify = *verify
+	if *eventsFile != "" {
+		f, err := os.Open(*eventsFile)
+		if err != nil {
+			log.Fatal("Error opening events file: ", err)
+		}
+		defer f.Close()
+		c.Events = f
+	}
+
+	r, err := harness.Run(c)
+	if err != nil {
+		log.Fatal("Error running harness: ", err)
+	}
+
+	log.Printf("Sent %d events and received %d notifications in %v", r.EventsSent, r.Notifications, r.Duration)
+	if !r.OK() {
+		for _, f := range r.Failures {
+			log.Println("FAILED:", f)
+			for i, d := range f.Discrepancies {
+				if i == maxDiscrepancies {
+					log.Printf("  ... and %d more", len(f.Discrepancies)-i)
+					break
+				}
+				log.Println(" ", d)
+			}
+		}
+		log.Printf("%d of %d user clients failed (seed %d)", len(r.Failures), c.ConcurrencyLevel, c.RandomSeed)
+		os.Exit(1)
+	}
+	log.Println("\\o/ ALL NOTIFICATIONS RECEIVED \\o/")
+}
@@ -0,0 +1,44 @@
+package events
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func BenchmarkParseEvent(b *testing.B) {
+	eh := newTestHandler()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := eh.parseEvent(goodEvents[i%len(goodEvents)].in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkQueuePushPop measures a push followed by a pop on a queue holding eventQueueSize
+// events, which is the steady state of the queue while events are streamed.
+func BenchmarkQueuePushPop(b *testing.B) {
+	// The queue logs as it starts and stops.
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+
+	qm := NewQueueManager()
+	stop := qm.Run()
+	defer func() {
+		stop <- true
+		qm.wait()
+	}()
+
+	for i := 0; i < eventQueueSize; i++ {
+		qm.pushEvent(event{sequence: i})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		qm.pushEvent(event{sequence: eventQueueSize + i})
+		qm.popEvent()
+	}
+}
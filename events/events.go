@@ -2,30 +2,42 @@ package events
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
-	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/johananl/follower-maze/userclients"
+	"github.com/johananl/follower-maze/internal/netutil"
 )
 
 // Server config
 const (
-	host = "localhost"
-	port = "9090"
+	host     = "localhost"
+	port     = "9090"
+	httpPort = "9091"
 )
 
-// Valid event types
+// Built-in event types
 const (
 	follow       string = "F"
 	unfollow     string = "U"
 	broadcast    string = "B"
 	privateMsg   string = "P"
 	statusUpdate string = "S"
+	block        string = "BL"
+	unblock      string = "UB"
+	mute         string = "MU"
+	unmute       string = "UM"
+	createGroup  string = "GC"
+	joinGroup    string = "GJ"
+	leaveGroup   string = "GL"
+	groupMsg     string = "GM"
 )
 
 // event represents an event received from the event source. Events are handled by an EventHandler.
@@ -38,14 +50,36 @@ type event struct {
 	eventType  string
 	fromUserID int
 	toUserID   int
+	groupID    int
 	index      int // Used for ordering in a priority queue
 }
 
 // EventHandler handles events. It saves them in a priority queue for ordering and communicates
-// with a UserHandler for user-related operations.
+// with a Notifier for user-related operations. Events are parsed and routed according to the
+// routes registered in router. If tlsConfig is set, event sources have to connect over TLS. If
+// recorder is set, the traffic of event sources is recorded. Listeners are created by listenFunc.
+// If eventHook is set, it is called with every event before it is routed. Events submitted over
+// HTTP are flushed by flushTimer once no batch was submitted for httpFlushDelay. Connections of
+// event sources are tracked in sources so that they can be closed on shutdown. Events are popped
+// and processed while holding processLock, so that they are processed in the order they were popped
+// whichever source they came from.
 type EventHandler struct {
 	queueManager *QueueManager
-	userHandler  *userclients.UserHandler
+	notifier     Notifier
+	router       *Router
+	tlsConfig    *tls.Config
+	recorder     *Recorder
+	listenFunc   func(network, address string) (net.Listener, error)
+	eventHook    func(Event)
+	processLock  sync.Mutex
+
+	httpFlushDelay time.Duration
+	flushTimer     *time.Timer
+	flushLock      sync.Mutex
+
+	sources *sources
+	running sync.WaitGroup
+	errs    chan error
 }
 
 // acceptConnections accepts TCP connections from event sources and sends back net.Conn structs.
@@ -53,7 +87,9 @@ func (eh *EventHandler) acceptConnections(l net.Listener) (<-chan net.Conn, chan
 	ch := make(chan net.Conn)
 	quit := make(chan bool)
 
+	eh.running.Add(1)
 	go func() {
+		defer eh.running.Done()
 		defer close(ch)
 		// Continually accept event connections. This loop iterates every time a new connection from an
 		// event source is received and blocks at Accept().
@@ -68,10 +104,16 @@ func (eh *EventHandler) acceptConnections(l net.Listener) (<-chan net.Conn, chan
 					return
 				default:
 				}
+				continue
 			}
 			log.Printf("Accepted an event connection from %v", conn.RemoteAddr())
 
-			ch <- conn
+			select {
+			case ch <- conn:
+			case <-quit:
+				conn.Close()
+				return
+			}
 		}
 	}()
 
@@ -83,22 +125,28 @@ func (eh *EventHandler) handleEvents(conn net.Conn) <-chan event {
 	ch := make(chan event)
 
 	go func() {
+		defer close(ch)
 		// Close connection when done reading.
 		defer func() {
-			// Send any events left in the queue after the event connection is closed.
-			log.Println("Flushing queue")
-			eh.flushQueue()
-
 			log.Println("Closing event connection")
 			conn.Close()
 		}()
 
+		recordID := 0
+		if eh.recorder != nil {
+			recordID = eh.recorder.open(conn.RemoteAddr())
+			defer eh.recorder.close(recordID)
+		}
+
 		br := bufio.NewReader(conn)
 		// Continually read from connection. This loop iterates every time a newline-delimited string
 		// is read from the TCP connection. The loop blocks at ReadString().
 		for {
 			// TODO Could get valid data AND an error?
 			message, err := br.ReadString('\n')
+			if eh.recorder != nil && message != "" {
+				eh.recorder.data(recordID, message)
+			}
 			if err != nil {
 				switch err {
 				case io.EOF:
@@ -108,8 +156,12 @@ func (eh *EventHandler) handleEvents(conn net.Conn) <-chan event {
 					log.Println("Got ErrClosedPipe on event connection")
 					return
 				default:
-					log.Println("Error reading event:", err.Error())
-					continue // Skip this event and move to the next one.
+					if netutil.IsTimeout(err) {
+						log.Println("Timed out reading event:", err.Error())
+						continue
+					}
+					log.Println("Error reading event - closing connection:", err.Error())
+					return
 				}
 			}
 
@@ -127,147 +179,252 @@ func (eh *EventHandler) handleEvents(conn net.Conn) <-chan event {
 	return ch
 }
 
-// The following patterns are used by parseEvent to match incoming events. They are initialized
-// outside the function because compiling regex patterns is very expensive and parseEvent is called
-// intensively.
-var fPattern = regexp.MustCompile(`^(\d+)\|F\|(\d+)\|(\d+)\n$`)
-var uPattern = regexp.MustCompile(`^(\d+)\|U\|(\d+)\|(\d+)\n$`)
-var bPattern = regexp.MustCompile(`^(\d+)\|B\n$`)
-var pPattern = regexp.MustCompile(`^(\d+)\|P\|(\d+)\|(\d+)\n$`)
-var sPattern = regexp.MustCompile(`^(\d+)\|S\|(\d+)\n$`)
+// serveEventSource enqueues the events read from an event source connection. Any events left in the
+// queue are sent once the connection is closed. The queue is flushed only after the last event of
+// the connection has been enqueued, so that no event is left behind.
+func (eh *EventHandler) serveEventSource(conn net.Conn) {
+	for e := range eh.handleEvents(conn) {
+		eh.enqueueEvent(e)
+	}
 
-// parseEvent gets a string and returns an event or an error.
-func (eh *EventHandler) parseEvent(e string) (event, error) {
-	var result event
-
-	if m := fPattern.FindStringSubmatch(e); len(m) != 0 {
-		seq, _ := strconv.Atoi(m[1])
-		fuid, _ := strconv.Atoi(m[2])
-		tuid, _ := strconv.Atoi(m[3])
-
-		result = event{
-			rawEvent:   e,
-			sequence:   seq,
-			eventType:  follow,
-			fromUserID: fuid,
-			toUserID:   tuid,
-		}
-	} else if m := uPattern.FindStringSubmatch(e); len(m) != 0 {
-		seq, _ := strconv.Atoi(m[1])
-		fuid, _ := strconv.Atoi(m[2])
-		tuid, _ := strconv.Atoi(m[3])
-		result = event{
-			rawEvent:   e,
-			sequence:   seq,
-			eventType:  unfollow,
-			fromUserID: fuid,
-			toUserID:   tuid,
-		}
-	} else if m := bPattern.FindStringSubmatch(e); len(m) != 0 {
-		seq, _ := strconv.Atoi(m[1])
-		result = event{
-			rawEvent:  e,
-			sequence:  seq,
-			eventType: broadcast,
+	log.Println("Flushing queue")
+	eh.flushQueue()
+}
+
+// eventPattern is used by parseEvent to match incoming events: a sequence, a type code and any
+// number of numeric fields. It is initialized outside the function because compiling regex
+// patterns is very expensive and parseEvent is called intensively.
+var eventPattern = regexp.MustCompile(`^(\d+)\|([A-Z]+)((?:\|\d+)*)\n$`)
+
+// parseFields parses the numeric fields which follow the type code of an event, including their
+// leading pipe.
+func parseFields(fields string) ([]int, error) {
+	if fields == "" {
+		return nil, nil
+	}
+
+	var result []int
+	for _, f := range strings.Split(fields[1:], "|") {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
 		}
-	} else if m := pPattern.FindStringSubmatch(e); len(m) != 0 {
-		seq, _ := strconv.Atoi(m[1])
-		fuid, _ := strconv.Atoi(m[2])
-		tuid, _ := strconv.Atoi(m[3])
-		result = event{
-			rawEvent:   e,
-			sequence:   seq,
-			eventType:  privateMsg,
-			fromUserID: fuid,
-			toUserID:   tuid,
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+// parseEvent gets a string and returns an event or an error. The number of fields an event has to
+// carry and their meaning are defined by the route registered for the event's type.
+func (eh *EventHandler) parseEvent(e string) (event, error) {
+	m := eventPattern.FindStringSubmatch(e)
+	if len(m) == 0 {
+		return event{}, errors.New("Invalid event: " + e)
+	}
+
+	seq, err := strconv.Atoi(m[1])
+	if err != nil {
+		return event{}, errors.New("Invalid sequence in event: " + e)
+	}
+
+	args, err := parseFields(m[3])
+	if err != nil {
+		return event{}, errors.New("Invalid user ID in event: " + e)
+	}
+
+	result := event{
+		rawEvent:  e,
+		sequence:  seq,
+		eventType: m[2],
+	}
+
+	route, ok, policy := eh.router.route(result.eventType)
+	if !ok {
+		if policy == RejectUnknown {
+			return event{}, errors.New("Invalid event type: " + e)
 		}
-	} else if m := sPattern.FindStringSubmatch(e); len(m) != 0 {
-		seq, _ := strconv.Atoi(m[1])
-		fuid, _ := strconv.Atoi(m[2])
-		result = event{
-			rawEvent:   e,
-			sequence:   seq,
-			eventType:  statusUpdate,
-			fromUserID: fuid,
+		return result, nil
+	}
+
+	if len(args) != len(route.Fields) {
+		return event{}, errors.New("Invalid number of fields in event: " + e)
+	}
+	for i, f := range route.Fields {
+		switch f {
+		case FromField:
+			result.fromUserID = args[i]
+		case ToField:
+			result.toUserID = args[i]
+		case GroupField:
+			result.groupID = args[i]
 		}
-	} else {
-		return event{}, errors.New("Invalid event: " + e)
 	}
 
 	return result, nil
 }
 
-// processEvent processes the received event. Depending on the event's type, processing may
-// include registering a Follow or Unfollow event and sending the event to one or more user
-// clients.
+// processEvent processes the received event using the route registered for its type. Depending on
+// the route, processing may include registering a Follow, Unfollow, Block, Mute or group
+// membership event and sending the event to one or more user clients.
 func (eh *EventHandler) processEvent(e event) {
-	switch e.eventType {
-	case follow:
-		// Register fromUserID as a follower of toUserID and notify toUserID.
-		eh.userHandler.Follow(e.fromUserID, e.toUserID)
-		eh.userHandler.NotifyUser(e.toUserID, e.rawEvent)
-	case unfollow:
-		// Remove fromUserID from toUserID's followers.
-		eh.userHandler.Unfollow(e.fromUserID, e.toUserID)
-	case broadcast:
-		// Notify all connected users.
-		for u := range eh.userHandler.Users {
-			eh.userHandler.NotifyUser(u, e.rawEvent)
-		}
-	case privateMsg:
-		// Notify toUserID.
-		eh.userHandler.NotifyUser(e.toUserID, e.rawEvent)
-	case statusUpdate:
-		// Notify all followers of fromUserID.
-		for _, u := range eh.userHandler.Followers(e.fromUserID) {
-			eh.userHandler.NotifyUser(u, e.rawEvent)
+	route, ok, policy := eh.router.route(e.eventType)
+	if !ok && policy != DefaultRouteUnknown {
+		// Events of unknown types which weren't rejected during parsing are dropped.
+		log.Println("Unknown event type " + e.eventType + " - ignoring")
+		return
+	}
+
+	ev := Event{
+		Raw:      e.rawEvent,
+		Sequence: e.sequence,
+		Type:     e.eventType,
+		From:     e.fromUserID,
+		To:       e.toUserID,
+		Group:    e.groupID,
+	}
+	if !ok {
+		// The fields of events of unknown types are only needed by the default route, so they are
+		// parsed here rather than stored in every event. The raw event has already been validated.
+		m := eventPattern.FindStringSubmatch(e.rawEvent)
+		ev.Args, _ = parseFields(m[3])
+	}
+	if eh.eventHook != nil {
+		eh.eventHook(ev)
+	}
+
+	if route.Apply != nil {
+		route.Apply(eh.notifier, ev)
+	}
+	if route.Recipients != nil {
+		for _, u := range route.Recipients(eh.notifier, ev) {
+			eh.notifier.Notify(u, e.rawEvent)
 		}
-	default:
-		// This is just for safety and good practice since all received events should have been
-		// parsed successfully and therefore should not have an invalid event type.
-		log.Println("Invalid event type - ignoring")
+	}
+}
+
+// enqueueEvent stores an event in the queue. If we have enough events in the queue, the top event
+// is processed. All event sources feed their events through this method so that events are ordered
+// regardless of how they were received.
+func (eh *EventHandler) enqueueEvent(e event) {
+	eh.processLock.Lock()
+	defer eh.processLock.Unlock()
+
+	if top, ok := eh.queueManager.pushPopEvent(e, eventQueueSize); ok {
+		eh.processEvent(top)
 	}
 }
 
 // flushQueue empties the queue by processing all remaining messages. This method is called once
 // the event source connection has been closed.
 func (eh *EventHandler) flushQueue() {
-	for eh.queueManager.queueLength() > 0 {
-		eh.processEvent(eh.queueManager.popEvent())
+	eh.processLock.Lock()
+	defer eh.processLock.Unlock()
+
+	for {
+		e, ok := eh.queueManager.tryPopEvent()
+		if !ok {
+			return
+		}
+		eh.processEvent(e)
 	}
 }
 
 // NewEventHandler constructs a new EventHandler and returns a pointer to it. It receives a pointer
-// to a QueueManager as well as a pointer to a UserHandler.
-func NewEventHandler(qm *QueueManager, uh *userclients.UserHandler) *EventHandler {
-	return &EventHandler{qm, uh}
+// to a QueueManager as well as the Notifier which holds user state and delivers notifications,
+// usually a *userclients.UserHandler. Events are routed by a router with routes for all built-in
+// event types.
+func NewEventHandler(qm *QueueManager, n Notifier) *EventHandler {
+	return &EventHandler{
+		queueManager:   qm,
+		notifier:       n,
+		router:         NewRouter(),
+		listenFunc:     net.Listen,
+		httpFlushDelay: defaultHTTPFlushDelay,
+		sources:        newSources(),
+		errs:           make(chan error, 2),
+	}
 }
 
-// Run starts the event handler.
+// SetRouter replaces the router used for parsing and routing events. It must be called before Run.
+func (eh *EventHandler) SetRouter(r *Router) {
+	eh.router = r
+}
+
+// SetTLSConfig makes the event handler's listeners accept TLS connections only. Setting a config
+// which requires client certificates restricts event submission to authorized producers. It must be
+// called before Run.
+func (eh *EventHandler) SetTLSConfig(config *tls.Config) {
+	eh.tlsConfig = config
+}
+
+// SetRecorder makes the event handler record the traffic of its event sources, including lines which
+// aren't valid events. It must be called before Run.
+func (eh *EventHandler) SetRecorder(r *Recorder) {
+	eh.recorder = r
+}
+
+// SetEventHook sets a function which is called with every event, in sequence order, before the event
+// is routed. The hook is called synchronously and holds up processing, so it should return quickly.
+// It must be called before Run.
+func (eh *EventHandler) SetEventHook(f func(Event)) {
+	eh.eventHook = f
+}
+
+// SetListenFunc replaces the function used for creating the event handler's listeners, which is
+// net.Listen by default. Tests may inject an in-memory implementation. It must be called before
+// Run.
+func (eh *EventHandler) SetListenFunc(f func(network, address string) (net.Listener, error)) {
+	eh.listenFunc = f
+}
+
+// listen creates a listener on the given port using the listen function, wrapped with TLS if a TLS
+// config was set.
+func (eh *EventHandler) listen(p string) (net.Listener, error) {
+	l, err := eh.listenFunc("tcp", host+":"+p)
+	if err != nil {
+		return nil, err
+	}
+	if eh.tlsConfig != nil {
+		l = tls.NewListener(l, eh.tlsConfig)
+	}
+
+	return l, nil
+}
+
+// Run starts the event handler. Once stopped, all event source connections are closed and the
+// events read from them are processed before the queue is stopped.
 func (eh *EventHandler) Run() chan<- bool {
-	// TODO Graceful shutdown
 	quit := make(chan bool)
 
+	// The queue is started right away so that events may be replayed once Run returns.
+	stopQueue := eh.queueManager.Run()
+	eh.sources.open()
+
+	eh.running.Add(1)
 	go func() {
-		// Start queue
-		stopQueue := eh.queueManager.Run()
+		defer eh.running.Done()
 		defer func() {
 			stopQueue <- true
+			eh.queueManager.wait()
 		}()
 
 		// Initialize event source listener
-		l, err := net.Listen("tcp", host+":"+port)
+		l, err := eh.listen(port)
 		if err != nil {
 			log.Println("Error listening for events:", err.Error())
-			// TODO Replace os.Exit()
-			os.Exit(1)
+			eh.errs <- err
+			<-quit
+			eh.sources.closeAll()
+			eh.sources.wait()
+			return
 		}
 		defer func() {
 			log.Println("Closing event listener")
 			l.Close()
 		}()
 
-		log.Println("Listening for events on " + host + ":" + port)
+		log.Println("Listening for events on " + l.Addr().String())
 
 		conns, stopAccept := eh.acceptConnections(l)
 		defer close(stopAccept)
@@ -275,18 +432,18 @@ func (eh *EventHandler) Run() chan<- bool {
 		for {
 			select {
 			case c := <-conns:
+				if !eh.sources.add(c) {
+					c.Close()
+					continue
+				}
 				go func() {
-					events := eh.handleEvents(c)
-					for e := range events {
-						eh.queueManager.pushEvent(e)
-						// If we have enough events in the queue, process the top event.
-						if eh.queueManager.queueLength() > eventQueueSize {
-							eh.processEvent(eh.queueManager.popEvent())
-						}
-					}
+					defer eh.sources.remove(c)
+					eh.serveEventSource(c)
 				}()
 			case <-quit:
 				log.Println("Stopping events handler")
+				eh.sources.closeAll()
+				eh.sources.wait()
 				return
 			}
 		}
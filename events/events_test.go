@@ -1,19 +1,24 @@
 package events
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/johananl/follower-maze/memnet"
 	"github.com/johananl/follower-maze/userclients"
 )
 
-var qm = NewQueueManager()
-var uh = userclients.NewUserHandler()
-var eh = NewEventHandler(qm, uh)
+// newTestHandler constructs an event handler with its own queue and user handler, so that tests
+// don't share state.
+func newTestHandler() *EventHandler {
+	return NewEventHandler(NewQueueManager(), userclients.NewUserHandler())
+}
 
 var goodEvents = []struct {
 	in  string
@@ -34,6 +39,30 @@ var goodEvents = []struct {
 	{"634|S|32\n",
 		event{rawEvent: "634|S|32\n", sequence: 634, eventType: statusUpdate, fromUserID: 32},
 	},
+	{"70|BL|1|2\n",
+		event{rawEvent: "70|BL|1|2\n", sequence: 70, eventType: block, fromUserID: 1, toUserID: 2},
+	},
+	{"71|UB|1|2\n",
+		event{rawEvent: "71|UB|1|2\n", sequence: 71, eventType: unblock, fromUserID: 1, toUserID: 2},
+	},
+	{"72|MU|3|4\n",
+		event{rawEvent: "72|MU|3|4\n", sequence: 72, eventType: mute, fromUserID: 3, toUserID: 4},
+	},
+	{"73|UM|3|4\n",
+		event{rawEvent: "73|UM|3|4\n", sequence: 73, eventType: unmute, fromUserID: 3, toUserID: 4},
+	},
+	{"80|GC|1|500\n",
+		event{rawEvent: "80|GC|1|500\n", sequence: 80, eventType: createGroup, fromUserID: 1, groupID: 500},
+	},
+	{"81|GJ|2|500\n",
+		event{rawEvent: "81|GJ|2|500\n", sequence: 81, eventType: joinGroup, fromUserID: 2, groupID: 500},
+	},
+	{"82|GL|2|500\n",
+		event{rawEvent: "82|GL|2|500\n", sequence: 82, eventType: leaveGroup, fromUserID: 2, groupID: 500},
+	},
+	{"83|GM|1|500\n",
+		event{rawEvent: "83|GM|1|500\n", sequence: 83, eventType: groupMsg, fromUserID: 1, groupID: 500},
+	},
 }
 
 var badEvents = []string{
@@ -48,9 +77,13 @@ var badEvents = []string{
 	" ",
 	"(&*(^*&^$$#",
 	"ばか猫",
+	"70|BL|1\n",
+	"72|MU\n",
+	"83|GM|1\n",
 }
 
 func TestParseEvent(t *testing.T) {
+	eh := newTestHandler()
 	for _, te := range goodEvents {
 		e, err := eh.parseEvent(te.in)
 		if err != nil {
@@ -63,6 +96,7 @@ func TestParseEvent(t *testing.T) {
 }
 
 func TestParseEventErrors(t *testing.T) {
+	eh := newTestHandler()
 	for _, te := range badEvents {
 		_, err := eh.parseEvent(te)
 		if err == nil {
@@ -80,6 +114,7 @@ var testEvent = event{
 }
 
 func TestPushEvent(t *testing.T) {
+	qm := NewQueueManager()
 	stop := qm.Run()
 
 	qm.pushEvent(testEvent)
@@ -93,6 +128,7 @@ func TestPushEvent(t *testing.T) {
 }
 
 func TestPopEvent(t *testing.T) {
+	qm := NewQueueManager()
 	stop := qm.Run()
 	qm.pushEvent(testEvent)
 
@@ -135,6 +171,7 @@ func TestQueueOrdering(t *testing.T) {
 	}
 
 	// Start queue
+	qm := NewQueueManager()
 	stop := qm.Run()
 
 	// Store events in queue
@@ -154,19 +191,20 @@ func TestQueueOrdering(t *testing.T) {
 	stop <- true
 }
 
-// TestAcceptConnections ensures that acceptConnections successfully returns net.Conn structs for TCP
+// TestAcceptConnections ensures that acceptConnections successfully returns net.Conn structs for
 // connections received from a listener.
 func TestAcceptConnections(t *testing.T) {
-	l, err := net.Listen("tcp", "localhost:9090")
+	n := memnet.NewNetwork()
+	l, err := n.Listen("tcp", "localhost:9090")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer l.Close()
 
-	ch, stop := eh.acceptConnections(l)
+	ch, stop := newTestHandler().acceptConnections(l)
 	defer close(stop)
 
-	cConn, err := net.Dial("tcp", "localhost:9090")
+	cConn, err := n.Dial("localhost:9090")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -175,11 +213,10 @@ func TestAcceptConnections(t *testing.T) {
 	sConn := <-ch
 	defer sConn.Close()
 
-	if cConn.LocalAddr().String() != sConn.RemoteAddr().String() {
-		t.Fatalf(
-			"Invalid connection received: %v != %v",
-			cConn.LocalAddr().String(), sConn.RemoteAddr().String(),
-		)
+	go cConn.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := sConn.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatal("Invalid connection received")
 	}
 }
 
@@ -191,7 +228,7 @@ func TestHandleEvents(t *testing.T) {
 		server.Close()
 	}()
 
-	events := eh.handleEvents(server)
+	events := newTestHandler().handleEvents(server)
 
 	for _, te := range goodEvents {
 		client.Write([]byte(te.in))
@@ -201,6 +238,71 @@ func TestHandleEvents(t *testing.T) {
 			t.Fatalf("Wrong event received: got %v, want %v", e, te.out)
 		}
 	}
+
+	// Wait for the connection to be closed so that other tests aren't affected.
+	client.Close()
+	for range events {
+	}
+}
+
+// brokenConn is a connection which fails every read with the same error, like a TLS connection
+// which received an invalid record.
+type brokenConn struct {
+	net.Conn
+	reads int32
+}
+
+func (c *brokenConn) Read(p []byte) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return 0, errors.New("local error: tls: bad record MAC")
+}
+
+func (c *brokenConn) Close() error { return nil }
+
+// TestHandleEventsReadError ensures that an event connection is closed, rather than read again,
+// once a read fails with an error which isn't a timeout.
+func TestHandleEventsReadError(t *testing.T) {
+	h := newTestHandler()
+	c := &brokenConn{}
+
+	select {
+	case _, ok := <-h.handleEvents(c):
+		if ok {
+			t.Fatal("Unexpected event received")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the connection to be closed")
+	}
+	if reads := atomic.LoadInt32(&c.reads); reads != 1 {
+		t.Fatalf("Invalid number of reads: got %d, want 1", reads)
+	}
 }
 
 // TODO Test event processing
+
+// TestRunListenError ensures that listen errors are reported instead of exiting, and that the
+// handler may still be stopped.
+func TestRunListenError(t *testing.T) {
+	eh := NewEventHandler(NewQueueManager(), userclients.NewUserHandler())
+	listenErr := errors.New("listen error")
+	eh.SetListenFunc(func(network, address string) (net.Listener, error) {
+		return nil, listenErr
+	})
+	stop := eh.Run()
+	stopHTTP := eh.RunHTTP()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-eh.Errors():
+			if err != listenErr {
+				t.Fatalf("Invalid error: got %v, want %v", err, listenErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Listen error not reported")
+		}
+	}
+
+	stopHTTP <- true
+	stop <- true
+	eh.Wait()
+}
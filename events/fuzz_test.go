@@ -0,0 +1,99 @@
+package events
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// encodeEvent encodes a parsed event in the canonical format, with the event's fields in the order
+// defined by the route of its type.
+func encodeEvent(e event, fields []string) string {
+	s := strconv.Itoa(e.sequence) + "|" + e.eventType
+	for _, f := range fields {
+		switch f {
+		case FromField:
+			s += "|" + strconv.Itoa(e.fromUserID)
+		case ToField:
+			s += "|" + strconv.Itoa(e.toUserID)
+		case GroupField:
+			s += "|" + strconv.Itoa(e.groupID)
+		}
+	}
+
+	return s + "\n"
+}
+
+// leadingZeros matches leading zeros of numbers, which are the only part of an event's encoding
+// that isn't canonical.
+var leadingZeros = regexp.MustCompile(`(^|\|)0+(\d)`)
+
+// FuzzParseEvent ensures that parseEvent never panics, and that every event it accepts keeps the
+// original raw event and round-trips through the canonical encoding.
+func FuzzParseEvent(f *testing.F) {
+	for _, te := range goodEvents {
+		f.Add(te.in)
+	}
+	for _, te := range badEvents {
+		f.Add(te)
+	}
+	f.Add("007|F|0|00\n")
+	f.Add("9223372036854775808|B\n")
+	f.Add("1|P|1|99999999999999999999\n")
+
+	eh := newTestHandler()
+	f.Fuzz(func(t *testing.T, in string) {
+		e, err := eh.parseEvent(in)
+		if err != nil {
+			return
+		}
+
+		if e.rawEvent != in {
+			t.Fatalf("Raw event not kept: got %q, want %q", e.rawEvent, in)
+		}
+		if e.sequence < 0 || e.fromUserID < 0 || e.toUserID < 0 || e.groupID < 0 {
+			t.Fatalf("Negative number parsed from %q: %+v", in, e)
+		}
+		route, ok, _ := eh.router.route(e.eventType)
+		if !ok {
+			t.Fatalf("Event of unknown type %q accepted", e.eventType)
+		}
+
+		canonical := encodeEvent(e, route.Fields)
+		if want := leadingZeros.ReplaceAllString(in, "$1$2"); canonical != want {
+			t.Fatalf("Invalid canonical encoding of %q: got %q, want %q", in, canonical, want)
+		}
+		e2, err := eh.parseEvent(canonical)
+		if err != nil {
+			t.Fatalf("Canonical encoding %q of %q doesn't parse: %v", canonical, in, err)
+		}
+		e2.rawEvent = e.rawEvent
+		if e2 != e {
+			t.Fatalf("Round trip of %q failed: got %+v, want %+v", in, e2, e)
+		}
+	})
+}
+
+// TestParseEventOverflow ensures that numbers which don't fit in an int are rejected rather than
+// wrapped around.
+func TestParseEventOverflow(t *testing.T) {
+	max := strconv.Itoa(int(^uint(0) >> 1))
+	overflow := max[:len(max)-1] + string(max[len(max)-1]+1)
+	eh := newTestHandler()
+
+	if _, err := eh.parseEvent(max + "|F|" + max + "|" + max + "\n"); err != nil {
+		t.Fatal("Largest int rejected:", err)
+	}
+	for _, in := range []string{
+		overflow + "|B\n",
+		"1|F|" + overflow + "|2\n",
+		"1|F|2|" + overflow + "\n",
+		"1|GM|2|" + overflow + "\n",
+		strings.Repeat("9", 100) + "|B\n",
+	} {
+		if _, err := eh.parseEvent(in); err == nil {
+			t.Fatalf("Expected to get an error: %q overflows", in)
+		}
+	}
+}
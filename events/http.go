@@ -0,0 +1,232 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchBytes limits the size of a batch of events submitted over HTTP.
+const maxBatchBytes = 1 << 20
+
+// defaultHTTPFlushDelay is the time after the last batch submitted over HTTP after which the queue
+// is flushed. HTTP producers don't hold a connection whose end marks the end of the stream, so a
+// quiet period is used instead.
+const defaultHTTPFlushDelay = 500 * time.Millisecond
+
+// jsonEvent is the JSON representation of an event. From, To and Group are omitted for event types
+// which don't use them. Args holds the fields of events of types without a registered route.
+type jsonEvent struct {
+	Sequence int    `json:"sequence"`
+	Type     string `json:"type"`
+	From     int    `json:"from,omitempty"`
+	To       int    `json:"to,omitempty"`
+	Group    int    `json:"group,omitempty"`
+	Args     []int  `json:"args,omitempty"`
+}
+
+// pipeFormat returns the event in the pipe-delimited format used by the TCP event source. The
+// fields are ordered as defined by the route registered for the event's type.
+func (je jsonEvent) pipeFormat(r *Router) string {
+	result := strconv.Itoa(je.Sequence) + "|" + je.Type
+
+	route, ok, _ := r.route(je.Type)
+	if !ok {
+		for _, a := range je.Args {
+			result += "|" + strconv.Itoa(a)
+		}
+		return result + "\n"
+	}
+
+	for _, f := range route.Fields {
+		switch f {
+		case FromField:
+			result += "|" + strconv.Itoa(je.From)
+		case ToField:
+			result += "|" + strconv.Itoa(je.To)
+		case GroupField:
+			result += "|" + strconv.Itoa(je.Group)
+		}
+	}
+
+	return result + "\n"
+}
+
+// eventResult is the outcome of submitting a single event over HTTP.
+type eventResult struct {
+	Event    string `json:"event"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// readBatch reads a batch of events from an HTTP request body and returns them in the
+// pipe-delimited format. JSON bodies hold an array of events; any other body holds one event per
+// line.
+func (eh *EventHandler) readBatch(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	body := http.MaxBytesReader(w, r.Body, maxBatchBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var batch []jsonEvent
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			return nil, err
+		}
+
+		result := make([]string, len(batch))
+		for i, je := range batch {
+			result[i] = je.pipeFormat(eh.router)
+		}
+
+		return result, nil
+	}
+
+	var result []string
+	s := bufio.NewScanner(body)
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		result = append(result, s.Text()+"\n")
+	}
+
+	return result, s.Err()
+}
+
+// handleBatch accepts a batch of events submitted over HTTP and feeds them into the queue, exactly
+// like events received from the TCP event source. The response holds a result for every event in
+// the batch, in the order in which they were submitted.
+func (eh *EventHandler) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	batch, err := eh.readBatch(w, r)
+	if err != nil {
+		log.Println("Error reading event batch:", err.Error())
+		http.Error(w, "Invalid event batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]eventResult, len(batch))
+	for i, raw := range batch {
+		results[i].Event = strings.TrimRight(raw, "\n")
+
+		e, err := eh.parseEvent(raw)
+		if err != nil {
+			log.Println("Event parsing failed:", err)
+			results[i].Error = err.Error()
+			continue
+		}
+
+		eh.enqueueEvent(e)
+		results[i].Accepted = true
+	}
+	eh.scheduleFlush()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results []eventResult `json:"results"`
+	}{results})
+}
+
+// scheduleFlush flushes the queue once no batch has been submitted over HTTP for the flush delay.
+// Every batch postpones the flush, so events of consecutive batches are still ordered by the queue.
+func (eh *EventHandler) scheduleFlush() {
+	eh.flushLock.Lock()
+	defer eh.flushLock.Unlock()
+
+	if eh.flushTimer == nil {
+		eh.flushTimer = time.AfterFunc(eh.httpFlushDelay, eh.timedFlush)
+		return
+	}
+	eh.flushTimer.Reset(eh.httpFlushDelay)
+}
+
+// timedFlush flushes the queue when the flush timer fires, unless the timer has been stopped by
+// stopFlush in the meantime.
+func (eh *EventHandler) timedFlush() {
+	eh.flushLock.Lock()
+	defer eh.flushLock.Unlock()
+
+	if eh.flushTimer != nil {
+		eh.flushQueue()
+	}
+}
+
+// stopFlush stops the flush timer and flushes the events of batches right away, so that none are
+// left in the queue once the HTTP handler has stopped.
+func (eh *EventHandler) stopFlush() {
+	eh.flushLock.Lock()
+	defer eh.flushLock.Unlock()
+
+	if eh.flushTimer != nil {
+		eh.flushTimer.Stop()
+		eh.flushTimer = nil
+		eh.flushQueue()
+	}
+}
+
+// RunHTTP starts accepting batches of events over HTTP at POST /events. Once stopped, the batches
+// being handled are completed and flushed.
+func (eh *EventHandler) RunHTTP() chan<- bool {
+	quit := make(chan bool)
+
+	eh.running.Add(1)
+	go func() {
+		defer eh.running.Done()
+
+		// Initialize HTTP listener
+		l, err := eh.listen(httpPort)
+		if err != nil {
+			log.Println("Error listening for HTTP events:", err.Error())
+			eh.errs <- err
+			<-quit
+			return
+		}
+
+		log.Println("Listening for HTTP events on " + l.Addr().String())
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/events", eh.handleBatch)
+		// Connections are counted from the time they are accepted until their handlers are done
+		// with them, which the server doesn't wait for when it is closed.
+		var conns sync.WaitGroup
+		srv := &http.Server{
+			Handler: mux,
+			ConnState: func(c net.Conn, state http.ConnState) {
+				switch state {
+				case http.StateNew:
+					conns.Add(1)
+				case http.StateHijacked, http.StateClosed:
+					conns.Done()
+				}
+			},
+		}
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Println("Error serving HTTP events:", err.Error())
+			}
+		}()
+
+		<-quit
+		log.Println("Stopping HTTP events handler")
+		log.Println("Closing HTTP event listener")
+		srv.Close()
+		<-served
+		conns.Wait()
+		eh.stopFlush()
+	}()
+
+	return quit
+}
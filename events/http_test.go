@@ -0,0 +1,79 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var batches = []struct {
+	contentType string
+	body        string
+}{
+	{"text/plain", "3|P|32|56\nabcd\n2|S|32\n"},
+	{"application/json", `[{"sequence":3,"type":"P","from":32,"to":56},{"sequence":4,"type":"X"},{"sequence":2,"type":"S","from":32}]`},
+}
+
+// TestHandleBatch ensures that every event in a batch submitted over HTTP gets a result and that
+// accepted events are delivered to users in order of sequence once the queue is flushed.
+func TestHandleBatch(t *testing.T) {
+	for _, tb := range batches {
+		n := newFakeNotifier()
+		n.Follow(56, 32)
+		h := NewEventHandler(NewQueueManager(), n)
+		h.httpFlushDelay = time.Millisecond
+		stop := h.queueManager.Run()
+
+		req := httptest.NewRequest("POST", "/events", strings.NewReader(tb.body))
+		req.Header.Set("Content-Type", tb.contentType)
+		w := httptest.NewRecorder()
+
+		h.handleBatch(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Invalid status code: got %d, want %d", w.Code, http.StatusOK)
+		}
+
+		var resp struct {
+			Results []eventResult `json:"results"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Results) != 3 {
+			t.Fatalf("Invalid number of results: got %d, want %d", len(resp.Results), 3)
+		}
+		for i, want := range []bool{true, false, true} {
+			if resp.Results[i].Accepted != want {
+				t.Fatalf("Invalid result for %v: got %v, want %v", resp.Results[i].Event, resp.Results[i].Accepted, want)
+			}
+		}
+
+		want := map[int][]string{56: {"2|S|32\n", "3|P|32|56\n"}}
+		if got := n.await(t, 2); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Invalid notifications: got %v, want %v", got, want)
+		}
+		stop <- true
+	}
+}
+
+func TestHandleBatchErrors(t *testing.T) {
+	eh := newTestHandler()
+	w := httptest.NewRecorder()
+	eh.handleBatch(w, httptest.NewRequest("GET", "/events", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Invalid status code: got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/events", strings.NewReader("{not json"))
+	req.Header.Set("Content-Type", "application/json")
+	eh.handleBatch(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid status code: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,52 @@
+package events
+
+// Notifier holds the user state which events act on and delivers notifications to users. An
+// EventHandler depends on a Notifier rather than on a specific user handler, so alternative delivery
+// backends and test doubles may be used. *userclients.UserHandler implements Notifier as well as
+// Relations and Groups.
+type Notifier interface {
+	// Follow registers from as a follower of to.
+	Follow(from, to int)
+	// Unfollow removes from from the followers of to.
+	Unfollow(from, to int)
+	// Notify sends a string-encoded event to a user.
+	Notify(id int, message string)
+	// Followers returns the followers of a user. The returned slice must not be modified by the
+	// Notifier afterwards.
+	Followers(id int) []int
+	// ConnectedUsers returns the IDs of all connected users.
+	ConnectedUsers() []int
+}
+
+// Relations is implemented by Notifiers which store blocks and mutes. Block and mute events have no
+// effect on Notifiers which don't implement it, and no users are considered blocked or muted.
+type Relations interface {
+	Block(from, to int)
+	Unblock(from, to int)
+	Blocked(a, b int) bool
+	Mute(from, to int)
+	Unmute(from, to int)
+	Muted(from, to int) bool
+}
+
+// Groups is implemented by Notifiers which store group membership. Group events have no effect on
+// Notifiers which don't implement it.
+type Groups interface {
+	CreateGroup(owner, group int) bool
+	JoinGroup(user, group int) bool
+	LeaveGroup(user, group int)
+	IsMember(user, group int) bool
+	GroupMembersSnapshot(group int) []int
+}
+
+// blocked reports whether either of the given users blocks the other, if n stores blocks.
+func blocked(n Notifier, a, b int) bool {
+	r, ok := n.(Relations)
+	return ok && r.Blocked(a, b)
+}
+
+// muted reports whether from has muted to, if n stores mutes.
+func muted(n Notifier, from, to int) bool {
+	r, ok := n.(Relations)
+	return ok && r.Muted(from, to)
+}
@@ -0,0 +1,121 @@
+package events
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johananl/follower-maze/userclients"
+)
+
+var (
+	_ Notifier  = (*userclients.UserHandler)(nil)
+	_ Relations = (*userclients.UserHandler)(nil)
+	_ Groups    = (*userclients.UserHandler)(nil)
+)
+
+// fakeNotifier is a Notifier which stores followers in a map and records notifications instead of
+// delivering them. Every notification is also signaled over notified. It implements neither
+// Relations nor Groups.
+type fakeNotifier struct {
+	lock          sync.Mutex
+	followers     map[int][]int
+	connected     []int
+	notifications map[int][]string
+	notified      chan struct{}
+}
+
+func newFakeNotifier(connected ...int) *fakeNotifier {
+	return &fakeNotifier{
+		followers:     make(map[int][]int),
+		connected:     connected,
+		notifications: make(map[int][]string),
+		notified:      make(chan struct{}, 100),
+	}
+}
+
+// await waits for count notifications and returns all notifications recorded so far.
+func (n *fakeNotifier) await(t *testing.T, count int) map[int][]string {
+	for i := 0; i < count; i++ {
+		select {
+		case <-n.notified:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for notification %d", i+1)
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.notifications
+}
+
+func (n *fakeNotifier) Follow(from, to int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.followers[to] = append(n.followers[to], from)
+}
+
+func (n *fakeNotifier) Unfollow(from, to int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var followers []int
+	for _, f := range n.followers[to] {
+		if f != from {
+			followers = append(followers, f)
+		}
+	}
+	n.followers[to] = followers
+}
+
+func (n *fakeNotifier) Notify(id int, message string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.notifications[id] = append(n.notifications[id], message)
+	n.notified <- struct{}{}
+}
+
+func (n *fakeNotifier) Followers(id int) []int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]int{}, n.followers[id]...)
+}
+
+func (n *fakeNotifier) ConnectedUsers() []int {
+	return n.connected
+}
+
+// TestNotifier ensures that an event handler routes events using any Notifier, and that block, mute
+// and group events have no effect on Notifiers which don't store them.
+func TestNotifier(t *testing.T) {
+	n := newFakeNotifier(1, 2)
+	h := NewEventHandler(NewQueueManager(), n)
+
+	for _, raw := range []string{
+		"1|F|2|1\n",
+		"2|F|3|1\n",
+		"3|BL|1|2\n",
+		"4|MU|3|1\n",
+		"5|S|1\n",
+		"6|U|3|1\n",
+		"7|P|1|2\n",
+		"8|GC|1|9\n",
+		"9|GM|1|9\n",
+		"10|B\n",
+	} {
+		e, err := h.parseEvent(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.processEvent(e)
+	}
+
+	want := map[int][]string{
+		1: {"1|F|2|1\n", "2|F|3|1\n", "10|B\n"},
+		2: {"5|S|1\n", "7|P|1|2\n", "10|B\n"},
+		3: {"5|S|1\n"},
+	}
+	if got := n.await(t, 7); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid notifications: got %v, want %v", got, want)
+	}
+}
@@ -15,36 +15,79 @@ const eventQueueSize = 200
 
 // QueueManager manages an event queue. The queue is a priority queue implemented using a min heap
 // data structure for event ordering. A heap provides a good solution here since it employs
-// efficient sorting upon insertion as well as quick retrieval at a constant time.
+// efficient sorting upon insertion as well as quick retrieval at a constant time. Operations are
+// sent to the goroutine started by Run over the manager's channels, so separate managers never
+// affect each other.
 type QueueManager struct {
-	queue *PriorityQueue
+	queue    *PriorityQueue
+	pushChan chan event
+	popChan  chan chan event
+	// tryPopChan carries pop requests which may find the queue empty, in which case nil is sent
+	// back.
+	tryPopChan chan chan *event
+	// pushPopChan carries push requests which also pop the top event if the queue grows beyond a
+	// window.
+	pushPopChan chan pushPop
+	lenChan     chan chan int
+	stopChan    chan bool
+	// stopped is closed once the queue has stopped.
+	stopped chan struct{}
 }
 
-var (
-	pushChan = make(chan event)
-	popChan  = make(chan chan event)
-	lenChan  = make(chan chan int)
-	stopChan = make(chan bool)
-)
+// pushPop is a request to push an event and then pop the top event if the queue holds more than
+// window events. The popped event is sent back over result, or nil if nothing was popped.
+type pushPop struct {
+	e      event
+	window int
+	result chan *event
+}
 
 // pushEvent stores an event in the queue.
 func (qm *QueueManager) pushEvent(e event) {
-	pushChan <- e
+	qm.pushChan <- e
 }
 
 // popEvent deletes the top (first) event in the queue and returns it.
 func (qm *QueueManager) popEvent() event {
 	result := make(chan event)
-	popChan <- result
+	qm.popChan <- result
 
 	return <-result
 }
 
+// tryPopEvent deletes the top event in the queue and returns it. The boolean result is false if the
+// queue is empty. Unlike checking the length before popping, this is safe when the queue is drained
+// by several goroutines concurrently.
+func (qm *QueueManager) tryPopEvent() (event, bool) {
+	result := make(chan *event)
+	qm.tryPopChan <- result
+
+	e := <-result
+	if e == nil {
+		return event{}, false
+	}
+	return *e, true
+}
+
+// pushPopEvent stores an event in the queue and, if the queue then holds more than window events,
+// deletes the top event and returns it. The boolean result is false if no event was popped. Both
+// operations are done at once, so the queue can't be drained by another goroutine in between.
+func (qm *QueueManager) pushPopEvent(e event, window int) (event, bool) {
+	result := make(chan *event)
+	qm.pushPopChan <- pushPop{e, window, result}
+
+	popped := <-result
+	if popped == nil {
+		return event{}, false
+	}
+	return *popped, true
+}
+
 // queueLength returns the length of the queue. This function is used mainly for validating queue
 // length during tests.
 func (qm *QueueManager) queueLength() int {
 	result := make(chan int)
-	lenChan <- result
+	qm.lenChan <- result
 
 	return <-result
 }
@@ -54,31 +97,61 @@ func (qm *QueueManager) queueLength() int {
 // safety.
 func (qm *QueueManager) Run() chan bool {
 	log.Println("Starting queue")
+	qm.stopped = make(chan struct{})
 	go func() {
+		defer close(qm.stopped)
 		for {
 			select {
-			case push := <-pushChan:
+			case push := <-qm.pushChan:
 				heap.Push(qm.queue, push)
-			case pop := <-popChan:
+			case pop := <-qm.popChan:
 				// TODO Why call heap here?
 				pop <- heap.Pop(qm.queue).(event)
-			case len := <-lenChan:
+			case pop := <-qm.tryPopChan:
+				if qm.queue.Len() == 0 {
+					pop <- nil
+					continue
+				}
+				e := heap.Pop(qm.queue).(event)
+				pop <- &e
+			case pp := <-qm.pushPopChan:
+				heap.Push(qm.queue, pp.e)
+				if qm.queue.Len() <= pp.window {
+					pp.result <- nil
+					continue
+				}
+				e := heap.Pop(qm.queue).(event)
+				pp.result <- &e
+			case len := <-qm.lenChan:
 				len <- qm.queue.Len()
-			case <-stopChan:
+			case <-qm.stopChan:
 				log.Println("Stopping queue")
 				return
 			}
 		}
 	}()
 
-	return stopChan
+	return qm.stopChan
+}
+
+// wait blocks until the queue has stopped after being signaled over the channel returned by Run.
+func (qm *QueueManager) wait() {
+	<-qm.stopped
 }
 
 // NewQueueManager constructs a new QueueManager and returns a pointer to it. It initializes the
 // queue's data structure (a min heap) and performs a heapify operation on it before returning.
 func NewQueueManager() *QueueManager {
 	pq := make(PriorityQueue, 0)
-	qm := QueueManager{queue: &pq}
+	qm := QueueManager{
+		queue:       &pq,
+		pushChan:    make(chan event),
+		popChan:     make(chan chan event),
+		tryPopChan:  make(chan chan *event),
+		pushPopChan: make(chan pushPop),
+		lenChan:     make(chan chan int),
+		stopChan:    make(chan bool),
+	}
 	heap.Init(qm.queue)
 
 	return &qm
@@ -0,0 +1,208 @@
+package events
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of records in a recording of event source traffic
+const (
+	recordOpen  = "O" // An event source connected. The data is its remote address.
+	recordData  = "D" // A line was read from an event source. The data is the quoted line.
+	recordClose = "C" // An event source disconnected.
+)
+
+// Recorder records the raw traffic of event sources so that it can be replayed later with the
+// exact arrival order. Every record is a line holding the arrival time in nanoseconds since the
+// Unix epoch, the ID of the connection, the kind of record and its data, e.g.:
+//
+//	1500000000000000000 1 O 127.0.0.1:53122
+//	1500000000000100000 1 D "666|F|60|50\n"
+//	1500000000000200000 1 C
+//
+// Recorders are safe for concurrent use.
+type Recorder struct {
+	w      io.Writer
+	lock   sync.Mutex
+	nextID int
+}
+
+// NewRecorder constructs a new Recorder which writes records to w and returns a pointer to it.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// write writes a single record.
+func (r *Recorder) write(id int, kind, data string) {
+	line := strconv.FormatInt(time.Now().UnixNano(), 10) + " " + strconv.Itoa(id) + " " + kind
+	if data != "" {
+		line += " " + data
+	}
+
+	if _, err := io.WriteString(r.w, line+"\n"); err != nil {
+		log.Println("Error recording event source traffic:", err.Error())
+	}
+}
+
+// open records a new connection and returns its ID.
+func (r *Recorder) open(addr net.Addr) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextID++
+	r.write(r.nextID, recordOpen, addr.String())
+
+	return r.nextID
+}
+
+// data records a line read from a connection.
+func (r *Recorder) data(id int, line string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.write(id, recordData, strconv.Quote(line))
+}
+
+// close records the end of a connection.
+func (r *Recorder) close(id int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.write(id, recordClose, "")
+}
+
+// record is a single parsed record of a recording.
+type record struct {
+	time int64
+	id   int
+	kind string
+	data string
+}
+
+// parseRecord parses a single line of a recording.
+func parseRecord(line string) (record, error) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+	if len(fields) < 3 {
+		return record{}, errors.New("Invalid record: " + line)
+	}
+
+	var r record
+	var err error
+	if r.time, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return record{}, errors.New("Invalid time in record: " + line)
+	}
+	if r.id, err = strconv.Atoi(fields[1]); err != nil {
+		return record{}, errors.New("Invalid connection ID in record: " + line)
+	}
+	r.kind = fields[2]
+
+	switch r.kind {
+	case recordOpen, recordClose:
+	case recordData:
+		if len(fields) < 4 {
+			return record{}, errors.New("Missing data in record: " + line)
+		}
+		if r.data, err = strconv.Unquote(fields[3]); err != nil {
+			return record{}, errors.New("Invalid data in record: " + line)
+		}
+	default:
+		return record{}, errors.New("Invalid record kind: " + line)
+	}
+
+	return r, nil
+}
+
+// Replay reads a recording of event source traffic and feeds it into the event handler as if the
+// event sources were connected again, preserving the recorded arrival order across connections.
+// speed scales the recorded timing: 1 replays at the original speed, 10 ten times faster, and 0 as
+// fast as possible. Replay returns once all replayed connections have been handled. The event
+// handler must be running: Replay returns ErrNotRunning if it isn't, or once it stops.
+func (eh *EventHandler) Replay(r io.Reader, speed float64) error {
+	stopped := eh.sources.done()
+	conns := make(map[int]net.Conn)
+	var wg sync.WaitGroup
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+		wg.Wait()
+	}()
+
+	// connect opens an in-memory connection which is handled like an accepted event source, and
+	// closed along with them when the event handler stops.
+	connect := func(id int) (net.Conn, error) {
+		client, server := net.Pipe()
+		if !eh.sources.add(server) {
+			client.Close()
+			server.Close()
+			return nil, ErrNotRunning
+		}
+		conns[id] = client
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer eh.sources.remove(server)
+			eh.serveEventSource(server)
+		}()
+		return client, nil
+	}
+
+	var start time.Time
+	var first int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		rec, err := parseRecord(line)
+		if err != nil {
+			return err
+		}
+
+		if start.IsZero() {
+			start, first = time.Now(), rec.time
+		} else if speed > 0 {
+			offset := time.Duration(float64(rec.time-first) / speed)
+			wait := time.NewTimer(time.Until(start.Add(offset)))
+			select {
+			case <-wait.C:
+			case <-stopped:
+				wait.Stop()
+				return ErrNotRunning
+			}
+		}
+
+		switch rec.kind {
+		case recordOpen:
+			if _, err := connect(rec.id); err != nil {
+				return err
+			}
+		case recordData:
+			c, ok := conns[rec.id]
+			if !ok {
+				// Recordings may start in the middle of a connection.
+				if c, err = connect(rec.id); err != nil {
+					return err
+				}
+			}
+			// Writes only fail once the connection was closed by the event handler stopping.
+			if _, err := c.Write([]byte(rec.data)); err != nil {
+				return ErrNotRunning
+			}
+		case recordClose:
+			if c, ok := conns[rec.id]; ok {
+				c.Close()
+				delete(conns, rec.id)
+			}
+		}
+	}
+}
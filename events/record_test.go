@@ -0,0 +1,154 @@
+package events
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johananl/follower-maze/memnet"
+)
+
+// TestRecord ensures that the traffic of an event source is recorded with its connection
+// boundaries, including lines which aren't valid events.
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	eh := newTestHandler()
+	eh.SetRecorder(NewRecorder(&buf))
+
+	client, server := net.Pipe()
+	events := eh.handleEvents(server)
+	go func() {
+		client.Write([]byte("2|B\nbogus\n1|P|1|2\n"))
+		client.Close()
+	}()
+	for range events {
+	}
+
+	var kinds, data []string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		r, err := parseRecord(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.id != 1 {
+			t.Fatalf("Invalid connection ID: got %d, want 1", r.id)
+		}
+		kinds = append(kinds, r.kind)
+		if r.kind == recordData {
+			data = append(data, r.data)
+		}
+	}
+	if want := []string{recordOpen, recordData, recordData, recordData, recordClose}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("Invalid records: got %v, want %v", kinds, want)
+	}
+	if want := []string{"2|B\n", "bogus\n", "1|P|1|2\n"}; !reflect.DeepEqual(data, want) {
+		t.Fatalf("Invalid recorded data: got %q, want %q", data, want)
+	}
+}
+
+// TestReplay ensures that a recording is fed back into the event handler, respecting the recorded
+// timing when replaying at the original speed.
+func TestReplay(t *testing.T) {
+	var lock sync.Mutex
+	var got []int
+	r := NewRouter()
+	r.Register("X", Route{
+		Apply: func(n Notifier, e Event) {
+			lock.Lock()
+			defer lock.Unlock()
+			got = append(got, e.Sequence)
+		},
+	})
+	eh := newTestHandler()
+	eh.SetRouter(r)
+	eh.SetListenFunc(memnet.NewNetwork().Listen)
+	stop := eh.Run()
+	defer func() {
+		stop <- true
+		eh.Wait()
+	}()
+
+	recording := `1000000000 1 O 127.0.0.1:1000
+1000000000 1 D "2|X\n"
+1010000000 2 O 127.0.0.1:1001
+1020000000 2 D "3|X\n"
+1030000000 1 D "1|X\n"
+1040000000 1 C
+1050000000 2 C
+`
+
+	if err := eh.Replay(strings.NewReader(recording), 0); err != nil {
+		t.Fatal(err)
+	}
+	// Connections are flushed independently, so events are only ordered within the queue.
+	sort.Ints(got)
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid replayed events: got %v, want %v", got, want)
+	}
+
+	got = nil
+	start := time.Now()
+	if err := eh.Replay(strings.NewReader(recording), 1); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("Replay at the original speed took %v, want at least 50ms", d)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Invalid number of replayed events: got %d, want 3", len(got))
+	}
+}
+
+// TestReplayNotRunning ensures that Replay fails rather than blocks if the event handler isn't
+// running or stops during the replay.
+func TestReplayNotRunning(t *testing.T) {
+	processed := make(chan int, 1)
+	r := NewRouter()
+	r.Register("X", Route{
+		Apply: func(n Notifier, e Event) {
+			processed <- e.Sequence
+		},
+	})
+	eh := newTestHandler()
+	eh.SetRouter(r)
+	eh.SetListenFunc(memnet.NewNetwork().Listen)
+
+	recording := `1000000000 1 O 127.0.0.1:1000
+1000000000 1 D "1|X\n"
+1000000000 1 C
+3600000000000 2 O 127.0.0.1:1001
+`
+	if err := eh.Replay(strings.NewReader(recording), 1); err != ErrNotRunning {
+		t.Fatalf("Invalid error replaying before running: got %v, want %v", err, ErrNotRunning)
+	}
+
+	stop := eh.Run()
+	done := make(chan error, 1)
+	go func() { done <- eh.Replay(strings.NewReader(recording), 1) }()
+	<-processed
+
+	// The replay now waits for the second connection, an hour later.
+	stop <- true
+	select {
+	case err := <-done:
+		if err != ErrNotRunning {
+			t.Fatalf("Invalid error replaying while stopping: got %v, want %v", err, ErrNotRunning)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Replay didn't return once the event handler stopped")
+	}
+	eh.Wait()
+}
+
+func TestParseRecordInvalid(t *testing.T) {
+	for _, line := range []string{"", "1 1", "x 1 O", "1 x O", "1 1 D", "1 1 D unquoted", "1 1 Z"} {
+		if _, err := parseRecord(line); err == nil {
+			t.Fatalf("No error for invalid record %q", line)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package events
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// Field names which may be used in Route.Fields
+const (
+	FromField  = "from"
+	ToField    = "to"
+	GroupField = "group"
+)
+
+// Event is a read-only view of an event which is passed to routes.
+type Event struct {
+	Raw      string
+	Sequence int
+	Type     string
+	From     int
+	To       int
+	Group    int
+	// Args holds the numeric fields following the type code. It is only set for events of types
+	// without a registered route since the fields of other types are mapped to From, To and Group.
+	Args []int
+}
+
+// Route defines how events of a single type are parsed and routed.
+type Route struct {
+	// Fields names the numeric fields which follow the type code, in order. Valid names are
+	// FromField, ToField and GroupField. Events with a different number of fields are rejected.
+	Fields []string
+	// Apply applies the side effects of the event on user state. It may be nil.
+	Apply func(n Notifier, e Event)
+	// Recipients returns the IDs of the users who should be notified of the event. It is called
+	// after Apply and may be nil, in which case no user is notified.
+	Recipients func(n Notifier, e Event) []int
+}
+
+// UnknownTypePolicy determines what happens to events of types without a registered route.
+type UnknownTypePolicy int
+
+const (
+	// RejectUnknown fails parsing of events of unknown types. This is the default.
+	RejectUnknown UnknownTypePolicy = iota
+	// DropUnknown accepts events of unknown types but never delivers them.
+	DropUnknown
+	// DefaultRouteUnknown routes events of unknown types using the router's default route.
+	DefaultRouteUnknown
+)
+
+// typePattern matches valid event type codes.
+var typePattern = regexp.MustCompile(`^[A-Z]+$`)
+
+// Router maps event type codes to routes. New event types can be supported by registering a route
+// for them, without modifying the event handler. Routers are safe for concurrent use.
+type Router struct {
+	routes       map[string]Route
+	unknown      UnknownTypePolicy
+	defaultRoute Route
+	lock         sync.RWMutex
+}
+
+// Register registers a route for an event type, replacing any route previously registered for it.
+func (r *Router) Register(eventType string, route Route) error {
+	if !typePattern.MatchString(eventType) {
+		return errors.New("Invalid event type: " + eventType)
+	}
+	for _, f := range route.Fields {
+		if f != FromField && f != ToField && f != GroupField {
+			return errors.New("Invalid field name: " + f)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes[eventType] = route
+
+	return nil
+}
+
+// SetUnknownTypePolicy sets the policy applied to events of types without a registered route. The
+// given route is only used with DefaultRouteUnknown, in which case its Fields are ignored and the
+// event's fields are passed in Event.Args.
+func (r *Router) SetUnknownTypePolicy(p UnknownTypePolicy, defaultRoute Route) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.unknown = p
+	r.defaultRoute = defaultRoute
+}
+
+// route returns the route for an event type. The boolean result is false if the type has no
+// registered route, in which case the returned route is the default route if the policy calls for
+// one.
+func (r *Router) route(eventType string) (Route, bool, UnknownTypePolicy) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if route, ok := r.routes[eventType]; ok {
+		return route, true, r.unknown
+	}
+
+	return r.defaultRoute, false, r.unknown
+}
+
+// NewRouter constructs a new Router with routes registered for all built-in event types and
+// returns a pointer to it.
+func NewRouter() *Router {
+	r := &Router{routes: make(map[string]Route)}
+	for t, route := range builtinRoutes {
+		r.routes[t] = route
+	}
+
+	return r
+}
+
+// builtinRoutes holds the routes of the built-in event types. Routes of block, mute and group events
+// only have an effect if the Notifier implements Relations or Groups.
+var builtinRoutes = map[string]Route{
+	follow: {
+		// Register From as a follower of To and notify To, unless either of them blocks the other.
+		Fields: []string{FromField, ToField},
+		Apply: func(n Notifier, e Event) {
+			if !blocked(n, e.From, e.To) {
+				n.Follow(e.From, e.To)
+			}
+		},
+		Recipients: func(n Notifier, e Event) []int {
+			if blocked(n, e.From, e.To) {
+				return nil
+			}
+			return []int{e.To}
+		},
+	},
+	unfollow: {
+		// Remove From from To's followers. No clients should be notified.
+		Fields: []string{FromField, ToField},
+		Apply: func(n Notifier, e Event) {
+			n.Unfollow(e.From, e.To)
+		},
+	},
+	broadcast: {
+		// Notify all connected users.
+		Recipients: func(n Notifier, e Event) []int {
+			return n.ConnectedUsers()
+		},
+	},
+	privateMsg: {
+		// Notify To, unless either of the users blocks the other.
+		Fields: []string{FromField, ToField},
+		Recipients: func(n Notifier, e Event) []int {
+			if blocked(n, e.From, e.To) {
+				return nil
+			}
+			return []int{e.To}
+		},
+	},
+	statusUpdate: {
+		// Notify all followers of From who haven't muted From.
+		Fields: []string{FromField},
+		Recipients: func(n Notifier, e Event) []int {
+			var result []int
+			for _, u := range n.Followers(e.From) {
+				if !muted(n, u, e.From) {
+					result = append(result, u)
+				}
+			}
+			return result
+		},
+	},
+	block: {
+		// Register the block and remove follows in both directions. No clients should be notified.
+		Fields: []string{FromField, ToField},
+		Apply: func(n Notifier, e Event) {
+			if r, ok := n.(Relations); ok {
+				r.Block(e.From, e.To)
+			}
+		},
+	},
+	unblock: {
+		Fields: []string{FromField, ToField},
+		Apply: func(n Notifier, e Event) {
+			if r, ok := n.(Relations); ok {
+				r.Unblock(e.From, e.To)
+			}
+		},
+	},
+	mute: {
+		// Suppress status updates of To for From. No clients should be notified.
+		Fields: []string{FromField, ToField},
+		Apply: func(n Notifier, e Event) {
+			if r, ok := n.(Relations); ok {
+				r.Mute(e.From, e.To)
+			}
+		},
+	},
+	unmute: {
+		Fields: []string{FromField, ToField},
+		Apply: func(n Notifier, e Event) {
+			if r, ok := n.(Relations); ok {
+				r.Unmute(e.From, e.To)
+			}
+		},
+	},
+	createGroup: {
+		// Create Group with From as its first member. No clients should be notified.
+		Fields: []string{FromField, GroupField},
+		Apply: func(n Notifier, e Event) {
+			if g, ok := n.(Groups); ok && !g.CreateGroup(e.From, e.Group) {
+				log.Printf("Group %d already exists - ignoring", e.Group)
+			}
+		},
+	},
+	joinGroup: {
+		Fields: []string{FromField, GroupField},
+		Apply: func(n Notifier, e Event) {
+			if g, ok := n.(Groups); ok && !g.JoinGroup(e.From, e.Group) {
+				log.Printf("Group %d doesn't exist - ignoring", e.Group)
+			}
+		},
+	},
+	leaveGroup: {
+		Fields: []string{FromField, GroupField},
+		Apply: func(n Notifier, e Event) {
+			if g, ok := n.(Groups); ok {
+				g.LeaveGroup(e.From, e.Group)
+			}
+		},
+	},
+	groupMsg: {
+		// Notify all current members of Group except the sender, who has to be a member, and
+		// members who block or are blocked by the sender.
+		Fields: []string{FromField, GroupField},
+		Recipients: func(n Notifier, e Event) []int {
+			g, ok := n.(Groups)
+			if !ok {
+				return nil
+			}
+			if !g.IsMember(e.From, e.Group) {
+				log.Printf("User %d isn't a member of group %d - ignoring", e.From, e.Group)
+				return nil
+			}
+			var result []int
+			for _, u := range g.GroupMembersSnapshot(e.Group) {
+				if u != e.From && !blocked(n, e.From, u) {
+					result = append(result, u)
+				}
+			}
+			return result
+		},
+	},
+}
@@ -0,0 +1,87 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegisterErrors(t *testing.T) {
+	r := NewRouter()
+	if err := r.Register("lower", Route{}); err == nil {
+		t.Fatal("Expected an invalid type code to be rejected")
+	}
+	if err := r.Register("X", Route{Fields: []string{"from", "nope"}}); err == nil {
+		t.Fatal("Expected an invalid field name to be rejected")
+	}
+}
+
+// TestCustomRoute ensures that events of a registered type are parsed according to the route's
+// fields and routed by it.
+func TestCustomRoute(t *testing.T) {
+	r := NewRouter()
+	var applied Event
+	err := r.Register("POKE", Route{
+		Fields: []string{GroupField, FromField},
+		Apply: func(n Notifier, e Event) {
+			applied = e
+		},
+		Recipients: func(n Notifier, e Event) []int {
+			return []int{e.From}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestHandler()
+	h.SetRouter(r)
+
+	e, err := h.parseEvent("9|POKE|7|3\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := event{rawEvent: "9|POKE|7|3\n", sequence: 9, eventType: "POKE", fromUserID: 3, groupID: 7}
+	if e != want {
+		t.Fatalf("Invalid event: got %v, want %v", e, want)
+	}
+
+	h.processEvent(e)
+	if applied.From != 3 || applied.Group != 7 || applied.Raw != "9|POKE|7|3\n" {
+		t.Fatalf("Route applied with an invalid event: %+v", applied)
+	}
+
+	if _, err := h.parseEvent("9|POKE|7\n"); err == nil {
+		t.Fatal("Expected an event with missing fields to be rejected")
+	}
+}
+
+func TestUnknownTypePolicy(t *testing.T) {
+	r := NewRouter()
+	h := newTestHandler()
+	h.SetRouter(r)
+
+	// Rejected by default
+	if _, err := h.parseEvent("5|ZAP|1|2\n"); err == nil {
+		t.Fatal("Expected an event of an unknown type to be rejected")
+	}
+
+	// Dropped
+	r.SetUnknownTypePolicy(DropUnknown, Route{})
+	e, err := h.parseEvent("5|ZAP|1|2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.processEvent(e)
+
+	// Passed to the default route
+	var applied Event
+	r.SetUnknownTypePolicy(DefaultRouteUnknown, Route{
+		Apply: func(n Notifier, e Event) {
+			applied = e
+		},
+	})
+	h.processEvent(e)
+	if applied.Type != "ZAP" || !reflect.DeepEqual(applied.Args, []int{1, 2}) {
+		t.Fatalf("Default route applied with an invalid event: %+v", applied)
+	}
+}
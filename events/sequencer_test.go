@@ -0,0 +1,183 @@
+package events
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/johananl/follower-maze/userclients"
+)
+
+// windowPermutation returns the sequences 1 to n in an order in which no event overtakes the window
+// of the queue: sequences are split into batches of random size, up to eventQueueSize, and shuffled
+// within every batch, just like the event source does. Full batches in reverse order, which are the
+// worst case for the queue, are generated more often than chance would.
+func windowPermutation(r *rand.Rand, n int) []int {
+	var result []int
+	for next := 1; next <= n; {
+		size := r.Intn(eventQueueSize) + 1
+		worst := r.Intn(4) == 0
+		if worst {
+			size = eventQueueSize
+		}
+		if size > n-next+1 {
+			size = n - next + 1
+		}
+		batch := make([]int, size)
+		for i := range batch {
+			batch[i] = next + i
+		}
+		if worst {
+			sort.Sort(sort.Reverse(sort.IntSlice(batch)))
+		} else {
+			r.Shuffle(size, func(i, j int) { batch[i], batch[j] = batch[j], batch[i] })
+		}
+		result = append(result, batch...)
+		next += size
+	}
+
+	return result
+}
+
+// TestQueuePreservesEvents checks the property that popping all pushed events returns every event
+// exactly once, in sequence order, for any multiset of sequences.
+func TestQueuePreservesEvents(t *testing.T) {
+	qm := NewQueueManager()
+	stop := qm.Run()
+	defer func() { stop <- true }()
+
+	property := func(sequences []uint16) bool {
+		for _, s := range sequences {
+			qm.pushEvent(event{sequence: int(s)})
+		}
+
+		var got []int
+		for {
+			e, ok := qm.tryPopEvent()
+			if !ok {
+				break
+			}
+			got = append(got, e.sequence)
+		}
+
+		want := make([]int, len(sequences))
+		for i, s := range sequences {
+			want[i] = int(s)
+		}
+		sort.Ints(want)
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSequencerWindow checks the property that events which arrive permuted within the queue's
+// window are processed in sequence order, exactly once, by the event handler.
+func TestSequencerWindow(t *testing.T) {
+	var processed []int
+	r := NewRouter()
+	r.Register("T", Route{
+		Apply: func(n Notifier, e Event) {
+			processed = append(processed, e.Sequence)
+		},
+	})
+	eh := NewEventHandler(NewQueueManager(), userclients.NewUserHandler())
+	eh.SetRouter(r)
+	stop := eh.queueManager.Run()
+	defer func() { stop <- true }()
+
+	property := func(seed int64, size uint16) bool {
+		processed = nil
+		n := int(size)%2000 + 1
+		for _, s := range windowPermutation(rand.New(rand.NewSource(seed)), n) {
+			e, err := eh.parseEvent(strconv.Itoa(s) + "|T\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			eh.enqueueEvent(e)
+		}
+		eh.flushQueue()
+
+		if len(processed) != n {
+			return false
+		}
+		for i, s := range processed {
+			if s != i+1 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(property, &quick.Config{MaxCount: 100}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentEnqueueFlush ensures that events enqueued by concurrent event sources are processed
+// in sequence order, and that flushing the queue afterwards loses no event. The queue is filled
+// with events older than all of the sources' events beforehand, so that every event the sources
+// pop is older than any event they push.
+func TestConcurrentEnqueueFlush(t *testing.T) {
+	var lock sync.Mutex
+	var processed []int
+	r := NewRouter()
+	r.Register("T", Route{
+		Apply: func(n Notifier, e Event) {
+			lock.Lock()
+			defer lock.Unlock()
+			processed = append(processed, e.Sequence)
+		},
+	})
+	eh := NewEventHandler(NewQueueManager(), userclients.NewUserHandler())
+	eh.SetRouter(r)
+	stop := eh.queueManager.Run()
+	defer func() { stop <- true }()
+
+	const sources, perSource = 4, 1000
+	parse := func(s int) event {
+		e, err := eh.parseEvent(strconv.Itoa(s) + "|T\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	for s := 1; s <= sources*perSource; s++ {
+		eh.queueManager.pushEvent(parse(s))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < sources; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perSource; j++ {
+				eh.enqueueEvent(parse(sources*perSource + j*sources + i + 1))
+			}
+		}(i)
+	}
+	wg.Wait()
+	eh.flushQueue()
+
+	if len(processed) != 2*sources*perSource {
+		t.Fatalf("Invalid number of processed events: got %d, want %d", len(processed), 2*sources*perSource)
+	}
+	for i, s := range processed {
+		if s != i+1 {
+			t.Fatalf("Event %d processed at position %d", s, i+1)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package events
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrNotRunning is returned by Replay if the event handler isn't running or stops during the
+// replay.
+var ErrNotRunning = errors.New("event handler not running")
+
+// sources tracks the connections of event sources so that they can be closed when the event
+// handler stops. A source is only removed once its events have been flushed, so waiting for the
+// sources guarantees that no event is processed after the queue has been stopped. Sources are only
+// accepted while the event handler is running, between open and closeAll, and stopped is closed
+// once they are being closed.
+type sources struct {
+	lock    sync.Mutex
+	conns   map[net.Conn]struct{}
+	running bool
+	stopped chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newSources() *sources {
+	stopped := make(chan struct{})
+	close(stopped)
+
+	return &sources{conns: make(map[net.Conn]struct{}), stopped: stopped}
+}
+
+// open starts accepting sources once the queue is running.
+func (s *sources) open() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running = true
+	s.stopped = make(chan struct{})
+}
+
+// done returns a channel which is closed once the sources are being closed, or right away if the
+// event handler isn't running.
+func (s *sources) done() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.stopped
+}
+
+// add starts tracking the connection of an event source. It returns false if the event handler
+// isn't running, in which case the caller should close the connection right away.
+func (s *sources) add(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.running {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+
+	return true
+}
+
+// remove stops tracking the connection of an event source which has been served.
+func (s *sources) remove(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+	s.wg.Done()
+}
+
+// closeAll closes the connections of all sources and stops accepting new ones.
+func (s *sources) closeAll() {
+	s.lock.Lock()
+	if s.running {
+		s.running = false
+		close(s.stopped)
+	}
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// wait blocks until all sources have been served.
+func (s *sources) wait() {
+	s.wg.Wait()
+}
+
+// Wait blocks until the event handler has stopped, once the channels returned by Run and RunHTTP
+// (if called) have been signaled. By then all event source connections have been closed and the
+// events read from them processed.
+func (eh *EventHandler) Wait() {
+	eh.running.Wait()
+}
+
+// Errors returns a channel which receives the errors that keep Run or RunHTTP from serving, such as
+// listen errors. The handler must still be stopped through the channel returned by the failed call.
+func (eh *EventHandler) Errors() <-chan error {
+	return eh.errs
+}
@@ -0,0 +1,202 @@
+// Package followermaze embeds a follower maze server in another program. A Server is constructed
+// with New, configured with options and run until its context is canceled:
+//
+//	s, err := followermaze.New(
+//		followermaze.OnDeliver(func(id int, notification string) {
+//			log.Printf("Notified user %d: %q", id, notification)
+//		}),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(s.Run(ctx))
+//
+// The server listens for event sources on EventAddr and for user clients on UserAddr unless other
+// addresses are configured, using the same protocols as the standalone server.
+package followermaze
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/johananl/follower-maze/events"
+	"github.com/johananl/follower-maze/userclients"
+)
+
+// Default listening addresses of a Server. The HTTP addresses are only listened on if HTTP is
+// enabled.
+const (
+	EventAddr     = "localhost:9090"
+	EventHTTPAddr = "localhost:9091"
+	UserAddr      = "localhost:9099"
+	UserHTTPAddr  = "localhost:9098"
+)
+
+// ErrStarted is returned by Run if the server has already been started.
+var ErrStarted = errors.New("followermaze: server already started")
+
+// ErrNotRunning is returned by Replay if the server isn't running or stops while replaying.
+var ErrNotRunning = events.ErrNotRunning
+
+// Event is an event received from an event source, as passed to OnEvent hooks.
+type Event = events.Event
+
+// Server is an embeddable follower maze server. Its state is only accessible through its methods,
+// which are safe for concurrent use while the server is running.
+type Server struct {
+	events *events.EventHandler
+	users  *userclients.UserHandler
+
+	listenFunc func(network, address string) (net.Listener, error)
+	addrs      map[string]string
+	http       bool
+	hooks      userclients.Hooks
+	webhook    *userclients.WebhookSink
+	started    int32
+}
+
+// New constructs a new Server configured by the given options and returns a pointer to it. It
+// returns an error if any of the options is invalid.
+func New(opts ...Option) (*Server, error) {
+	uh := userclients.NewUserHandler()
+	s := &Server{
+		events:     events.NewEventHandler(events.NewQueueManager(), uh),
+		users:      uh,
+		listenFunc: net.Listen,
+		addrs:      make(map[string]string),
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	s.users.SetHooks(s.hooks)
+
+	return s, nil
+}
+
+// Run starts the server and blocks until ctx is canceled, after which the server is stopped: its
+// listeners and connections are closed and Run returns once all of its handlers are done. It
+// returns an error right away if any of the listeners can't be created, in which case it may be
+// run again. Otherwise a server may only be run once. If a handler fails once started, the server
+// is stopped as if ctx had been canceled and the handler's error is returned.
+func (s *Server) Run(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return ErrStarted
+	}
+
+	// Listeners are created up front so that failures are returned to the caller. The handlers
+	// then pick them up through their listen functions, which are called with the default
+	// addresses.
+	addrs := []string{EventAddr, UserAddr}
+	if s.http {
+		addrs = append(addrs, EventHTTPAddr, UserHTTPAddr)
+	}
+	listeners := make(map[string]net.Listener)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		l, err := s.listenFunc("tcp", s.addr(addr))
+		if err != nil {
+			atomic.StoreInt32(&s.started, 0)
+			return err
+		}
+		listeners[addr] = l
+	}
+	listen := func(network, address string) (net.Listener, error) {
+		l, ok := listeners[address]
+		if !ok {
+			return nil, errors.New("followermaze: no listener for " + address)
+		}
+		return l, nil
+	}
+	s.events.SetListenFunc(listen)
+	s.users.SetListenFunc(listen)
+
+	var stopEventsHTTP, stopUsersHTTP, stopWebhook chan<- bool
+	if s.webhook != nil {
+		stopWebhook = s.webhook.Run()
+	}
+	stopUsers := s.users.Run()
+	stopEvents := s.events.Run()
+	if s.http {
+		stopUsersHTTP = s.users.RunHTTP()
+		stopEventsHTTP = s.events.RunHTTP()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-s.events.Errors():
+	case err = <-s.users.Errors():
+	}
+
+	// Event sources are stopped first so that the events already read from them are delivered to
+	// the users, and the users before the webhook so that it is sent everything left undelivered.
+	if s.http {
+		stopEventsHTTP <- true
+	}
+	stopEvents <- true
+	s.events.Wait()
+	if s.http {
+		stopUsersHTTP <- true
+	}
+	stopUsers <- true
+	s.users.Wait()
+	if s.webhook != nil {
+		stopWebhook <- true
+		s.webhook.Wait()
+	}
+
+	return err
+}
+
+// addr returns the address configured in place of the given default address.
+func (s *Server) addr(def string) string {
+	if addr, ok := s.addrs[def]; ok {
+		return addr
+	}
+
+	return def
+}
+
+// ConnectedUsers returns the IDs of all connected users.
+func (s *Server) ConnectedUsers() []int {
+	return s.users.ConnectedUsers()
+}
+
+// Followers returns the followers of the given user ID.
+func (s *Server) Followers(id int) []int {
+	return s.users.Followers(id)
+}
+
+// Following returns the users followed by the given user ID.
+func (s *Server) Following(id int) []int {
+	return s.users.Following(id)
+}
+
+// HandshakeStats returns the outcome counts of user client handshakes.
+func (s *Server) HandshakeStats() userclients.HandshakeStats {
+	return s.users.HandshakeStats()
+}
+
+// WebhookStats returns the counters of the webhook sink, or zero counters if no webhook was
+// configured.
+func (s *Server) WebhookStats() userclients.WebhookStats {
+	if s.webhook == nil {
+		return userclients.WebhookStats{}
+	}
+	return s.webhook.Stats()
+}
+
+// Replay replays event source traffic recorded with WithRecorder. It returns ErrNotRunning if the
+// server isn't running, or once it stops if it does so before the traffic has been replayed.
+func (s *Server) Replay(r io.Reader, speed float64) error {
+	return s.events.Replay(r, speed)
+}
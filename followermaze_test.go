@@ -0,0 +1,296 @@
+package followermaze
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johananl/follower-maze/memnet"
+)
+
+// recv waits for a value on ch and fails the test if none arrives in time.
+func recv(t *testing.T, ch <-chan string) string {
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a hook to be called")
+		return ""
+	}
+}
+
+// TestServerHooks runs a server on an in-memory network and ensures that its hooks are called as a
+// user connects, is notified and disconnects, and that Run returns once the context is canceled.
+func TestServerHooks(t *testing.T) {
+	n := memnet.NewNetwork()
+	calls := make(chan string, 10)
+	s, err := New(
+		WithListenFunc(n.Listen),
+		OnEvent(func(e Event) { calls <- "event " + e.Type }),
+		OnConnect(func(id int) { calls <- "connect" }),
+		OnDeliver(func(id int, notification string) { calls <- "deliver " + notification }),
+		OnDisconnect(func(id int) { calls <- "disconnect" }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	<-n.Listening(UserAddr)
+	<-n.Listening(EventAddr)
+
+	user, err := n.Dial(UserAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Write([]byte("1\n"))
+	if got := recv(t, calls); got != "connect" {
+		t.Fatalf("Invalid hook call: got %q, want %q", got, "connect")
+	}
+	if got := s.ConnectedUsers(); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("Invalid connected users: got %v, want [1]", got)
+	}
+
+	notifications := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(user).ReadString('\n')
+		notifications <- line
+	}()
+
+	source, err := n.Dial(EventAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Write([]byte("1|B\n"))
+	source.Close()
+
+	for _, want := range []string{"event B", "deliver 1|B\n"} {
+		if got := recv(t, calls); got != want {
+			t.Fatalf("Invalid hook call: got %q, want %q", got, want)
+		}
+	}
+	if got := recv(t, notifications); got != "1|B\n" {
+		t.Fatalf("Invalid notification: got %q, want %q", got, "1|B\n")
+	}
+
+	user.Close()
+	if got := recv(t, calls); got != "disconnect" {
+		t.Fatalf("Invalid hook call: got %q, want %q", got, "disconnect")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was canceled")
+	}
+	if err := s.Run(context.Background()); err != ErrStarted {
+		t.Fatalf("Invalid error running a server twice: got %v, want %v", err, ErrStarted)
+	}
+}
+
+// TestServerShutdown ensures that Run closes the connections of users and event sources and only
+// returns once their handlers are done.
+func TestServerShutdown(t *testing.T) {
+	n := memnet.NewNetwork()
+	calls := make(chan string, 2)
+	s, err := New(
+		WithListenFunc(n.Listen),
+		OnConnect(func(id int) { calls <- "connect" }),
+		OnDisconnect(func(id int) { calls <- "disconnect" }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	<-n.Listening(UserAddr)
+	<-n.Listening(EventAddr)
+
+	user, err := n.Dial(UserAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Write([]byte("1\n"))
+	if got := recv(t, calls); got != "connect" {
+		t.Fatalf("Invalid hook call: got %q, want %q", got, "connect")
+	}
+	source, err := n.Dial(EventAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Write([]byte("1|B\n"))
+
+	// The event is still queued, and must be delivered before the user is disconnected.
+	notifications := make(chan string, 2)
+	go func() {
+		br := bufio.NewReader(user)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				close(notifications)
+				return
+			}
+			notifications <- line
+		}
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was canceled")
+	}
+
+	// The user must have been unregistered by the time Run returned.
+	select {
+	case got := <-calls:
+		if got != "disconnect" {
+			t.Fatalf("Invalid hook call: got %q, want %q", got, "disconnect")
+		}
+	default:
+		t.Fatal("User not disconnected when Run returned")
+	}
+	if got := s.ConnectedUsers(); len(got) != 0 {
+		t.Fatalf("Users still connected after Run returned: %v", got)
+	}
+	if got := recv(t, notifications); got != "1|B\n" {
+		t.Fatalf("Invalid notification: got %q, want %q", got, "1|B\n")
+	}
+	if _, ok := <-notifications; ok {
+		t.Fatal("User connection not closed")
+	}
+	if _, err := source.Write([]byte("2|B\n")); err == nil {
+		t.Fatal("Event source connection not closed")
+	}
+}
+
+// TestServerListenError ensures that Run returns listening errors instead of exiting.
+func TestServerListenError(t *testing.T) {
+	n := memnet.NewNetwork()
+	l, err := n.Listen("tcp", UserAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, err := New(WithListenFunc(n.Listen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("Expected an error listening on an address in use")
+	}
+
+	// The event listener created before the failure must have been closed.
+	el, err := n.Listen("tcp", EventAddr)
+	if err != nil {
+		t.Fatalf("Event listener wasn't closed: %v", err)
+	}
+	el.Close()
+
+	// Once the address is free, the server may be run again.
+	l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	<-n.Listening(UserAddr)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Error running a server after a listening error: %v", err)
+	}
+}
+
+// TestServerAddrs ensures that the server listens on the configured addresses.
+func TestServerAddrs(t *testing.T) {
+	n := memnet.NewNetwork()
+	calls := make(chan string, 1)
+	s, err := New(
+		WithListenFunc(n.Listen),
+		WithEventAddr("events:1"),
+		WithUserAddr("users:1"),
+		OnConnect(func(id int) { calls <- "connect" }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	<-n.Listening("events:1")
+	<-n.Listening("users:1")
+
+	user, err := n.Dial("users:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Write([]byte("1\n"))
+	if got := recv(t, calls); got != "connect" {
+		t.Fatalf("Invalid hook call: got %q, want %q", got, "connect")
+	}
+	if _, err := n.Dial(UserAddr); err == nil {
+		t.Fatal("Expected the default user address not to be listened on")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServerReplayNotRunning ensures that Replay returns an error unless the server is running.
+func TestServerReplayNotRunning(t *testing.T) {
+	n := memnet.NewNetwork()
+	s, err := New(WithListenFunc(n.Listen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := "0 1 O\n0 1 D \"1|F|2|1\\n\"\n0 1 C\n"
+	if err := s.Replay(strings.NewReader(recording), 1); err != ErrNotRunning {
+		t.Fatalf("Invalid error replaying before Run: got %v, want %v", err, ErrNotRunning)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	<-n.Listening(EventAddr)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replay(strings.NewReader(recording), 1); err != ErrNotRunning {
+		t.Fatalf("Invalid error replaying after Run: got %v, want %v", err, ErrNotRunning)
+	}
+}
+
+// TestNewInvalidOptions ensures that New rejects invalid options.
+func TestNewInvalidOptions(t *testing.T) {
+	tests := []Option{
+		WithListenFunc(nil),
+		WithAuthenticator(nil),
+		WithRouter(nil),
+		WithGraph(nil),
+		WithHandshakeLimits(time.Second, 0),
+		WithHandshakeLimits(-time.Second, 1),
+		WithEventAddr(""),
+		WithUserHTTPAddr(""),
+	}
+	for i, opt := range tests {
+		if _, err := New(opt); err == nil {
+			t.Fatalf("Expected option %d to be rejected", i)
+		}
+	}
+}
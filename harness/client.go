@@ -0,0 +1,181 @@
+package harness
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// extraGrace is how long a user client keeps listening after receiving all of its expected
+// notifications, in order to detect unexpected extra ones.
+const extraGrace = 200 * time.Millisecond
+
+// client is a user client which verifies the notifications it receives against the notifications
+// it is told to expect.
+type client struct {
+	id       int
+	conn     net.Conn
+	br       *bufio.Reader
+	received int
+
+	lock     sync.Mutex
+	expected []string // Expected notifications which haven't been received yet, or all of them when recording
+	total    int      // Number of notifications expected so far
+	log      []string // Notifications received, when recording
+}
+
+// dialClient connects a user client with dial and identifies it. It returns once the server has
+// registered the user, which is confirmed by a command round trip, so that no notification is
+// missed.
+func dialClient(dial func(network, address string) (net.Conn, error), addr string, id int) (*client, error) {
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{id: id, conn: conn, br: bufio.NewReader(conn)}
+	if _, err := conn.Write([]byte(strconv.Itoa(id) + "\n?FOLLOWERS\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := c.br.ReadString('\n'); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// expect queues a notification the client should receive.
+func (c *client) expect(message string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expected = append(c.expected, message)
+	c.total++
+}
+
+// next pops the next expected notification. The boolean result is false if none is queued.
+func (c *client) next() (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.expected) == 0 {
+		return "", false
+	}
+	message := c.expected[0]
+	c.expected = c.expected[1:]
+
+	return message, true
+}
+
+// pending returns the number of expected notifications which haven't been received yet.
+func (c *client) pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.expected)
+}
+
+// failure returns a Failure of the client with the given reason.
+func (c *client) failure(reason string) Failure {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return Failure{UserID: c.id, Received: c.received, Expected: c.total, Reason: reason}
+}
+
+// verify reads notifications and compares them to the expected ones until the event source is done
+// (done is closed) and all expected notifications were received. It fails on the first unexpected
+// notification, or if no notification arrives within timeout while some are still expected.
+func (c *client) verify(timeout time.Duration, done <-chan struct{}) (Failure, bool) {
+	for {
+		finished := isDone(done) && c.pending() == 0
+		if finished {
+			c.conn.SetReadDeadline(time.Now().Add(extraGrace))
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		message, err := c.br.ReadString('\n')
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && finished {
+				return Failure{}, true
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && c.pending() == 0 {
+				// Nothing is expected yet, keep waiting for the event source.
+				continue
+			}
+			return c.failure("error waiting for notification: " + err.Error()), false
+		}
+		if strings.HasPrefix(message, "?") {
+			continue // Command responses aren't notifications.
+		}
+
+		want, ok := c.next()
+		if !ok {
+			return c.failure("unexpected notification " + strconv.Quote(message)), false
+		}
+		if message != want {
+			return c.failure("got " + strconv.Quote(message) + ", want " + strconv.Quote(want)), false
+		}
+		c.lock.Lock()
+		c.received++
+		c.lock.Unlock()
+	}
+}
+
+// record reads and records notifications until the event source is done (done is closed) and at
+// least as many notifications as expected were received, or until no notification arrives within
+// timeout. It then compares the recorded notifications to the expected ones and reports all
+// discrepancies. Expected notifications are never popped while recording.
+func (c *client) record(timeout time.Duration, done <-chan struct{}) (Failure, bool) {
+	for {
+		c.lock.Lock()
+		finished := isDone(done) && len(c.log) >= c.total
+		c.lock.Unlock()
+		if finished {
+			c.conn.SetReadDeadline(time.Now().Add(extraGrace))
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+
+		message, err := c.br.ReadString('\n')
+		if err != nil {
+			// Keep waiting while the event source is sending, and give up on notifications which
+			// don't arrive in time once it is done.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !finished && !isDone(done) {
+				continue
+			}
+			break
+		}
+		if strings.HasPrefix(message, "?") {
+			continue // Command responses aren't notifications.
+		}
+
+		c.lock.Lock()
+		c.log = append(c.log, message)
+		c.received++
+		c.lock.Unlock()
+	}
+
+	c.lock.Lock()
+	diff := Diff(c.expected, c.log)
+	c.lock.Unlock()
+	if len(diff) == 0 {
+		return Failure{}, true
+	}
+	f := c.failure(strconv.Itoa(len(diff)) + " discrepancies")
+	f.Discrepancies = diff
+
+	return f, false
+}
+
+// isDone reports whether done is closed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,77 @@
+package harness
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+// generator produces a deterministic stream of random events of the original five types, in
+// sequence order. Two generators with the same seed and number of users produce the same stream.
+type generator struct {
+	r        *rand.Rand
+	users    int
+	sequence int
+}
+
+func newGenerator(seed int64, users int) *generator {
+	return &generator{r: rand.New(rand.NewSource(seed)), users: users}
+}
+
+// user returns a random user ID.
+func (g *generator) user() string {
+	return strconv.Itoa(g.r.Intn(g.users) + 1)
+}
+
+// next returns the next event, including its trailing newline.
+func (g *generator) next() string {
+	g.sequence++
+	seq := strconv.Itoa(g.sequence)
+
+	// Weights roughly follow a social network: mostly follows, messages and status updates, with
+	// occasional unfollows and rare broadcasts.
+	switch n := g.r.Intn(100); {
+	case n < 30:
+		return seq + "|F|" + g.user() + "|" + g.user() + "\n"
+	case n < 40:
+		return seq + "|U|" + g.user() + "|" + g.user() + "\n"
+	case n < 42:
+		return seq + "|B\n"
+	case n < 70:
+		return seq + "|P|" + g.user() + "|" + g.user() + "\n"
+	default:
+		return seq + "|S|" + g.user() + "\n"
+	}
+}
+
+// batch returns up to max events, in random order. The number of events is random too, but never
+// exceeds the events left to generate out of total.
+func (g *generator) batch(max, total int) []string {
+	n := g.r.Intn(max) + 1
+	if left := total - g.sequence; n > left {
+		n = left
+	}
+
+	result := make([]string, n)
+	for i := range result {
+		result[i] = g.next()
+	}
+	g.r.Shuffle(len(result), func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
+
+	return result
+}
+
+// connectedUsers returns the IDs of the users whose clients connect, chosen at random out of all
+// users.
+func (g *generator) connectedUsers(n int) []int {
+	if n > g.users {
+		n = g.users
+	}
+	result := g.r.Perm(g.users)[:n]
+	for i := range result {
+		result[i]++
+	}
+
+	return result
+}
@@ -0,0 +1,304 @@
+// Package harness emulates the followermaze test harness: an event source which sends a random,
+// partially shuffled stream of events and user clients which verify that they receive exactly the
+// notifications they should, in order. Runs are deterministic for a given random seed, so failures
+// can be reproduced.
+package harness
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config configures a run of the harness. Its fields mirror the configuration of the original
+// harness.
+type Config struct {
+	EventAddr  string // Address of the server's event source listener
+	ClientAddr string // Address of the server's user client listener
+	// TotalEvents is the number of events sent by the event source.
+	TotalEvents int
+	// ConcurrencyLevel is the number of connected user clients.
+	ConcurrencyLevel int
+	// NumberOfUsers is the total number of users, connected or not.
+	NumberOfUsers int
+	// RandomSeed seeds the generation of events and the choice of connected users.
+	RandomSeed int64
+	// Timeout is the time user clients wait for a new notification before giving up.
+	Timeout time.Duration
+	// MaxEventSourceBatchSize is the maximum number of events sent in a single batch. Events are
+	// shuffled within every batch, so a size of 1 results in events being sent in order.
+	MaxEventSourceBatchSize int
+	// Events optionally holds a recorded stream of events, one per line or as recorded by the
+	// server's -record-events flag. If set, these events are sent in the recorded order, in
+	// batches of MaxEventSourceBatchSize, instead of random ones.
+	Events io.Reader
+	// Verify makes user clients record every notification and report all discrepancies between
+	// the expected and received notifications, instead of failing on the first unexpected one.
+	Verify bool
+	// Dial optionally replaces net.Dial for connecting the event source and the user clients, e.g.
+	// to run against a server on an in-memory network.
+	Dial func(network, address string) (net.Conn, error)
+}
+
+// DefaultConfig returns the default configuration of the original harness.
+func DefaultConfig() Config {
+	return Config{
+		EventAddr:               "localhost:9090",
+		ClientAddr:              "localhost:9099",
+		TotalEvents:             10000000,
+		ConcurrencyLevel:        100,
+		NumberOfUsers:           1000,
+		RandomSeed:              666,
+		Timeout:                 20 * time.Second,
+		MaxEventSourceBatchSize: 100,
+	}
+}
+
+// Failure describes a user client which didn't receive the notifications it expected.
+type Failure struct {
+	UserID   int
+	Received int // Number of notifications received
+	Expected int // Number of notifications expected
+	Reason   string
+	// Discrepancies lists all differences between the expected and received notifications. It is
+	// only set when verifying.
+	Discrepancies []Discrepancy
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("user %d: received %d of %d notifications: %s", f.UserID, f.Received, f.Expected, f.Reason)
+}
+
+// Report summarizes a run of the harness.
+type Report struct {
+	EventsSent    int
+	Notifications int // Notifications received by all user clients
+	Failures      []Failure
+	Duration      time.Duration
+}
+
+// OK reports whether all user clients received exactly the notifications they expected.
+func (r Report) OK() bool {
+	return len(r.Failures) == 0
+}
+
+// Run runs the harness against a server: it connects the user clients, sends all events from the
+// event source and waits for the user clients to verify their notifications. An error is returned
+// if the server can't be reached. Verification failures are listed in the report.
+func Run(c Config) (Report, error) {
+	if c.TotalEvents < 0 || c.ConcurrencyLevel < 1 || c.NumberOfUsers < 1 || c.MaxEventSourceBatchSize < 1 {
+		return Report{}, errors.New("invalid harness configuration")
+	}
+	dial := c.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	start := time.Now()
+
+	g := newGenerator(c.RandomSeed, c.NumberOfUsers)
+	ids := g.connectedUsers(c.ConcurrencyLevel)
+	m := newModel(ids)
+
+	// nextBatch returns the next batch of events to send, or nil once all events were sent. The
+	// notifications expected for a batch are queued before it is sent, so clients always know what
+	// to expect next.
+	var nextBatch func() []string
+	var recorded []string
+	if c.Events != nil {
+		var err error
+		if recorded, err = readEvents(c.Events); err != nil {
+			return Report{}, err
+		}
+		nextBatch = func() []string {
+			n := c.MaxEventSourceBatchSize
+			if n > len(recorded) {
+				n = len(recorded)
+			}
+			batch := recorded[:n]
+			recorded = recorded[n:]
+			return batch
+		}
+	} else {
+		nextBatch = func() []string {
+			if g.sequence >= c.TotalEvents {
+				return nil
+			}
+			return g.batch(c.MaxEventSourceBatchSize, c.TotalEvents)
+		}
+	}
+
+	clients := make(map[int]*client, len(ids))
+	defer func() {
+		for _, cl := range clients {
+			cl.conn.Close()
+		}
+	}()
+	for _, id := range ids {
+		cl, err := dialClient(dial, c.ClientAddr, id)
+		if err != nil {
+			return Report{}, err
+		}
+		clients[id] = cl
+	}
+	log.Printf("Connected %d user clients", len(clients))
+
+	source, err := dial("tcp", c.EventAddr)
+	if err != nil {
+		return Report{}, err
+	}
+
+	results := make(chan Failure, len(clients))
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, cl := range clients {
+		wg.Add(1)
+		go func(cl *client) {
+			defer wg.Done()
+			verify := cl.verify
+			if c.Verify {
+				verify = cl.record
+			}
+			if f, ok := verify(c.Timeout, done); !ok {
+				results <- f
+			}
+		}(cl)
+	}
+
+	if c.Events != nil {
+		// Recorded events may be out of order across batches, so expectations for all of them are
+		// computed upfront.
+		for _, e := range sortedBySequence(recorded) {
+			for _, id := range m.apply(e) {
+				clients[id].expect(e)
+			}
+		}
+	}
+
+	sent := 0
+	w := bufio.NewWriter(source)
+	for batch := nextBatch(); len(batch) > 0; batch = nextBatch() {
+		if c.Events == nil {
+			for _, e := range sortedBySequence(batch) {
+				for _, id := range m.apply(e) {
+					clients[id].expect(e)
+				}
+			}
+		}
+		for _, e := range batch {
+			w.WriteString(e)
+		}
+		if err := w.Flush(); err != nil {
+			source.Close()
+			return Report{}, err
+		}
+		sent += len(batch)
+	}
+	source.Close()
+	log.Printf("Sent %d events", sent)
+	close(done)
+
+	wg.Wait()
+	close(results)
+
+	r := Report{EventsSent: sent, Duration: time.Since(start)}
+	for _, cl := range clients {
+		r.Notifications += cl.received
+	}
+	for f := range results {
+		r.Failures = append(r.Failures, f)
+	}
+	sort.Slice(r.Failures, func(i, j int) bool {
+		return r.Failures[i].UserID < r.Failures[j].UserID
+	})
+
+	return r, nil
+}
+
+// readEvents reads a recorded stream of events in the order in which they should be sent. Events
+// are either listed one per line, or recorded by the server's -record-events flag, in which case
+// the lines read from all event sources are sent in their order of arrival.
+func readEvents(r io.Reader) ([]string, error) {
+	var result []string
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" && strings.HasSuffix(line, "\n") {
+			e, ok, rerr := parseRecordedEvent(line)
+			if rerr != nil {
+				return nil, rerr
+			}
+			if !ok {
+				e = line
+			}
+			if strings.HasSuffix(e, "\n") {
+				result = append(result, e)
+			}
+		}
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRecordedEvent parses a line of a recording written by the server, e.g.
+// `1500000000000100000 1 D "666|F|60|50\n"`, and returns the line read from the event source. ok is
+// false if the line isn't a record. Records of connections opening and closing are returned as
+// empty lines.
+func parseRecordedEvent(line string) (e string, ok bool, err error) {
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+	if len(fields) < 3 {
+		return "", false, nil
+	}
+	for _, f := range fields[:2] {
+		if _, err := strconv.ParseInt(f, 10, 64); err != nil {
+			return "", false, nil
+		}
+	}
+
+	switch fields[2] {
+	case "O", "C":
+		return "", true, nil
+	case "D":
+		if len(fields) < 4 {
+			return "", false, errors.New("missing data in record: " + line)
+		}
+		e, err := strconv.Unquote(fields[3])
+		if err != nil {
+			return "", false, errors.New("invalid data in record: " + line)
+		}
+		return e, true, nil
+	default:
+		return "", false, nil
+	}
+}
+
+// sortedBySequence returns a copy of a batch of events sorted by sequence.
+func sortedBySequence(batch []string) []string {
+	result := append([]string{}, batch...)
+	sort.Slice(result, func(i, j int) bool {
+		return sequenceOf(result[i]) < sequenceOf(result[j])
+	})
+
+	return result
+}
+
+// sequenceOf returns the sequence of an event, or 0 if it doesn't start with a valid one.
+func sequenceOf(e string) int {
+	i := strings.IndexByte(e, '|')
+	if i < 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(e[:i])
+	return n
+}
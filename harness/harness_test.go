@@ -0,0 +1,195 @@
+package harness
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johananl/follower-maze/mazetest"
+)
+
+// TestGeneratorDeterministic ensures that generators with the same seed produce the same events and
+// choose the same connected users.
+func TestGeneratorDeterministic(t *testing.T) {
+	a, b := newGenerator(42, 100), newGenerator(42, 100)
+
+	if got, want := a.connectedUsers(10), b.connectedUsers(10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Connected users differ: %v and %v", got, want)
+	}
+	for i := 0; i < 100; i++ {
+		if got, want := a.batch(20, 1000), b.batch(20, 1000); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Batches differ: %v and %v", got, want)
+		}
+	}
+}
+
+// TestGeneratorBatch ensures that batches hold consecutive sequences, never exceed the max batch
+// size and stop at the total number of events.
+func TestGeneratorBatch(t *testing.T) {
+	g := newGenerator(1, 10)
+	next := 1
+	for g.sequence < 500 {
+		batch := g.batch(7, 500)
+		if len(batch) < 1 || len(batch) > 7 {
+			t.Fatalf("Invalid batch size %d", len(batch))
+		}
+		for _, e := range sortedBySequence(batch) {
+			if s := sequenceOf(e); s != next {
+				t.Fatalf("Invalid sequence: got %d, want %d", s, next)
+			}
+			next++
+		}
+	}
+	if g.sequence != 500 {
+		t.Fatalf("Invalid number of events: got %d, want 500", g.sequence)
+	}
+}
+
+// TestModel ensures that the model notifies connected users only, as defined by the routing rules.
+func TestModel(t *testing.T) {
+	m := newModel([]int{1, 2, 3})
+
+	tests := []struct {
+		event string
+		want  []int
+	}{
+		{"1|F|2|1\n", []int{1}},
+		{"2|F|3|1\n", []int{1}},
+		{"3|F|1|9\n", nil},
+		{"4|F|9|1\n", []int{1}},
+		{"5|S|1\n", []int{2, 3}},
+		{"6|U|2|1\n", nil},
+		{"7|S|1\n", []int{3}},
+		{"8|P|1|2\n", []int{2}},
+		{"9|P|1|9\n", nil},
+		{"10|B\n", []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		got := m.apply(tt.event)
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("Invalid recipients of %q: got %v, want %v", tt.event, got, tt.want)
+		}
+	}
+}
+
+// TestModelRelations ensures that the model applies blocks, mutes and groups like the server does.
+func TestModelRelations(t *testing.T) {
+	m := newModel([]int{1, 2, 3})
+
+	tests := []struct {
+		event string
+		want  []int
+	}{
+		{"1|F|2|1\n", []int{1}},
+		{"2|F|3|1\n", []int{1}},
+		{"3|MU|3|1\n", nil},
+		{"4|S|1\n", []int{2}},
+		{"5|BL|1|2\n", nil},
+		{"6|S|1\n", nil},
+		{"7|P|2|1\n", nil},
+		{"8|F|2|1\n", nil},
+		{"9|UB|1|2\n", nil},
+		{"10|GC|1|7\n", nil},
+		{"11|GJ|2|7\n", nil},
+		{"12|GJ|3|8\n", nil},
+		{"13|GM|1|7\n", []int{2}},
+		{"14|GM|3|7\n", nil},
+		{"15|XX|1|2\n", nil},
+		{"x|B\n", nil},
+	}
+	for _, tt := range tests {
+		got := m.apply(tt.event)
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("Invalid recipients of %q: got %v, want %v", tt.event, got, tt.want)
+		}
+	}
+}
+
+// TestDiff ensures that missing, extra and out-of-order notifications are reported by sequence.
+func TestDiff(t *testing.T) {
+	expected := []string{"1|B\n", "2|B\n", "3|B\n", "4|B\n", "5|B\n", "6|B\n"}
+	received := []string{"1|B\n", "3|B\n", "4|B\n", "2|B\n", "4|B\n", "9|B\n", "6|B\n"}
+
+	want := []Discrepancy{
+		{OutOfOrder, 2, "2|B"},
+		{Extra, 4, "4|B"},
+		{Missing, 5, "5|B"},
+		{Extra, 9, "9|B"},
+	}
+	if got := Diff(expected, received); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid diff: got %v, want %v", got, want)
+	}
+
+	if got := Diff(expected, expected); len(got) != 0 {
+		t.Fatalf("Discrepancies found in identical notifications: %v", got)
+	}
+}
+
+// TestReadEvents ensures that recorded events are read either one per line or from a recording of
+// the server's event source traffic, in order of arrival.
+func TestReadEvents(t *testing.T) {
+	want := []string{"2|B\n", "3|P|1|2\n", "1|F|2|1\n"}
+	for _, in := range []string{
+		"2|B\n3|P|1|2\n1|F|2|1\n",
+		`1000000000 1 O 127.0.0.1:1000
+1000000000 1 D "2|B\n"
+1010000000 2 O 127.0.0.1:1001
+1020000000 2 D "3|P|1|2\n"
+1030000000 1 D "1|F|2|1\n"
+1040000000 1 C
+1050000000 2 C
+`,
+	} {
+		got, err := readEvents(strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Invalid events: got %q, want %q", got, want)
+		}
+	}
+
+	if _, err := readEvents(strings.NewReader("1000000000 1 D unquoted\n")); err == nil {
+		t.Fatal("Expected an error reading a record with invalid data")
+	}
+}
+
+// TestRun runs the harness end to end against a fresh in-memory server, both failing on the first
+// unexpected notification and verifying all of them, and ensures that no discrepancy is reported.
+func TestRun(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		s := mazetest.NewServer()
+
+		c := DefaultConfig()
+		c.EventAddr = mazetest.EventAddr
+		c.ClientAddr = mazetest.UserAddr
+		c.TotalEvents = 2000
+		c.ConcurrencyLevel = 10
+		c.NumberOfUsers = 50
+		c.Timeout = 5 * time.Second
+		c.Verify = verify
+		c.Dial = func(network, address string) (net.Conn, error) {
+			return s.Network.Dial(address)
+		}
+
+		r, err := Run(c)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.OK() {
+			t.Fatalf("Verify %v: unexpected failures: %v", verify, r.Failures)
+		}
+		if r.EventsSent != c.TotalEvents {
+			t.Fatalf("Verify %v: invalid number of events sent: got %d, want %d", verify, r.EventsSent, c.TotalEvents)
+		}
+		if r.Notifications == 0 {
+			t.Fatalf("Verify %v: no notifications received", verify)
+		}
+	}
+}
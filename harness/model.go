@@ -0,0 +1,134 @@
+package harness
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// eventPattern matches events the server accepts. Other events are rejected and never notified.
+var eventPattern = regexp.MustCompile(`^\d+\|[A-Z]+(\|\d+)*\n$`)
+
+// pair is a directed relationship between two users.
+type pair struct {
+	from, to int
+}
+
+// model is an independent reference implementation of the server's routing rules. It tracks
+// follows, blocks, mutes and group membership and computes which connected users should be notified
+// of every event, without any knowledge of the server's implementation. Events of unknown types are
+// expected to be dropped.
+type model struct {
+	followers map[int]map[int]bool
+	blocks    map[pair]bool
+	mutes     map[pair]bool
+	groups    map[int]map[int]bool
+	connected map[int]bool
+	// order lists the connected users in a fixed order, so that recipients of broadcasts are
+	// returned deterministically.
+	order []int
+}
+
+func newModel(connected []int) *model {
+	m := &model{
+		followers: make(map[int]map[int]bool),
+		blocks:    make(map[pair]bool),
+		mutes:     make(map[pair]bool),
+		groups:    make(map[int]map[int]bool),
+		connected: make(map[int]bool),
+		order:     connected,
+	}
+	for _, id := range connected {
+		m.connected[id] = true
+	}
+
+	return m
+}
+
+// blocked reports whether either of the given users blocks the other.
+func (m *model) blocked(a, b int) bool {
+	return m.blocks[pair{a, b}] || m.blocks[pair{b, a}]
+}
+
+// follow registers from as a follower of to.
+func (m *model) follow(from, to int) {
+	if m.followers[to] == nil {
+		m.followers[to] = make(map[int]bool)
+	}
+	m.followers[to][from] = true
+}
+
+// apply applies an event to the model and returns the connected users who should be notified of it.
+// Events have to be applied in sequence order.
+func (m *model) apply(e string) []int {
+	if !eventPattern.MatchString(e) {
+		return nil
+	}
+	fields := strings.Split(strings.TrimSuffix(e, "\n"), "|")
+	ids := make([]int, len(fields)-2)
+	for i, f := range fields[2:] {
+		ids[i], _ = strconv.Atoi(f)
+	}
+
+	var recipients []int
+	switch t := fields[1]; {
+	case t == "B" && len(ids) == 0:
+		return append([]int{}, m.order...)
+	case len(ids) == 1 && t == "S":
+		for id := range m.followers[ids[0]] {
+			if !m.mutes[pair{id, ids[0]}] {
+				recipients = append(recipients, id)
+			}
+		}
+	case len(ids) != 2:
+		return nil
+	case t == "F":
+		if !m.blocked(ids[0], ids[1]) {
+			m.follow(ids[0], ids[1])
+			recipients = []int{ids[1]}
+		}
+	case t == "U":
+		delete(m.followers[ids[1]], ids[0])
+	case t == "P":
+		if !m.blocked(ids[0], ids[1]) {
+			recipients = []int{ids[1]}
+		}
+	case t == "BL":
+		m.blocks[pair{ids[0], ids[1]}] = true
+		delete(m.followers[ids[1]], ids[0])
+		delete(m.followers[ids[0]], ids[1])
+	case t == "UB":
+		delete(m.blocks, pair{ids[0], ids[1]})
+	case t == "MU":
+		m.mutes[pair{ids[0], ids[1]}] = true
+	case t == "UM":
+		delete(m.mutes, pair{ids[0], ids[1]})
+	case t == "GC":
+		if m.groups[ids[1]] == nil {
+			m.groups[ids[1]] = map[int]bool{ids[0]: true}
+		}
+	case t == "GJ":
+		if members := m.groups[ids[1]]; members != nil {
+			members[ids[0]] = true
+		}
+	case t == "GL":
+		delete(m.groups[ids[1]], ids[0])
+	case t == "GM":
+		if m.groups[ids[1]][ids[0]] {
+			for id := range m.groups[ids[1]] {
+				if id != ids[0] && !m.blocked(ids[0], id) {
+					recipients = append(recipients, id)
+				}
+			}
+		}
+	}
+
+	var result []int
+	for _, id := range recipients {
+		if m.connected[id] {
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
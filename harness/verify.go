@@ -0,0 +1,126 @@
+package harness
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DiscrepancyKind classifies a difference between expected and received notifications.
+type DiscrepancyKind int
+
+// Kinds of discrepancies
+const (
+	// Missing notifications were expected but never received.
+	Missing DiscrepancyKind = iota
+	// Extra notifications were received but not expected, or received more than once.
+	Extra
+	// OutOfOrder notifications were expected and received, but after a notification with a
+	// higher sequence.
+	OutOfOrder
+)
+
+func (k DiscrepancyKind) String() string {
+	switch k {
+	case Missing:
+		return "missing"
+	case Extra:
+		return "extra"
+	case OutOfOrder:
+		return "out of order"
+	default:
+		return "unknown"
+	}
+}
+
+// Discrepancy is a single difference between the notifications a user client was expected to
+// receive and the ones it received.
+type Discrepancy struct {
+	Kind     DiscrepancyKind
+	Sequence int
+	Event    string // The notification, without its trailing newline
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s: %d (%s)", d.Kind, d.Sequence, d.Event)
+}
+
+// Diff compares the notifications a user client received to the ones it was expected to receive,
+// in sequence order. Notifications are reported as missing or extra if they appear in only one of
+// the lists, and as out of order if they appear in both but not in sequence order. The smallest
+// set of notifications which, when moved, would fix the order is reported. Discrepancies are
+// sorted by sequence.
+func Diff(expected, received []string) []Discrepancy {
+	var result []Discrepancy
+	discrepancy := func(k DiscrepancyKind, e string) Discrepancy {
+		return Discrepancy{Kind: k, Sequence: sequenceOf(e), Event: e[:len(e)-1]}
+	}
+
+	want := make(map[string]bool, len(expected))
+	for _, e := range expected {
+		want[e] = true
+	}
+
+	// Notifications received as expected, in the order in which they were received.
+	var common []string
+	seen := make(map[string]bool, len(received))
+	for _, e := range received {
+		if !want[e] || seen[e] {
+			result = append(result, discrepancy(Extra, e))
+			continue
+		}
+		seen[e] = true
+		common = append(common, e)
+	}
+	for _, e := range expected {
+		if !seen[e] {
+			result = append(result, discrepancy(Missing, e))
+		}
+	}
+
+	inOrder := longestIncreasing(common)
+	for i, e := range common {
+		if !inOrder[i] {
+			result = append(result, discrepancy(OutOfOrder, e))
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Sequence < result[j].Sequence
+	})
+
+	return result
+}
+
+// longestIncreasing finds a longest subsequence of events with increasing sequences and reports
+// which of the events belong to it.
+func longestIncreasing(events []string) []bool {
+	// tails[k] is the index of the smallest possible last event of an increasing subsequence of
+	// length k+1, and prev links every event to its predecessor in such a subsequence.
+	var tails []int
+	prev := make([]int, len(events))
+	for i, e := range events {
+		s := sequenceOf(e)
+		k := sort.Search(len(tails), func(k int) bool {
+			return sequenceOf(events[tails[k]]) >= s
+		})
+		if k > 0 {
+			prev[i] = tails[k-1]
+		} else {
+			prev[i] = -1
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+
+	result := make([]bool, len(events))
+	if len(tails) > 0 {
+		for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+			result[i] = true
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,13 @@
+// Package netutil holds helpers for reading from connections which are shared by the event and
+// user handlers.
+package netutil
+
+import "net"
+
+// IsTimeout reports whether err is a network timeout. A connection may still be read from after a
+// read timed out. Other read errors, such as those of TLS connections, are returned by every
+// following read, so the connection should be closed.
+func IsTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,34 @@
+package netutil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestIsTimeout ensures that only network timeouts are reported as such.
+func TestIsTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	server.SetReadDeadline(time.Now())
+	_, timeout := server.Read(make([]byte, 1))
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{timeout, true},
+		{io.EOF, false},
+		{io.ErrClosedPipe, false},
+		{errors.New("tls: bad record MAC"), false},
+	}
+
+	for _, tc := range tests {
+		if got := IsTimeout(tc.err); got != tc.want {
+			t.Fatalf("Invalid result for %v: got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mazetest
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Parameters of the end-to-end benchmark
+const (
+	benchUsers     = 100
+	benchBatchSize = 100
+)
+
+// BenchmarkEndToEnd sends private messages in order over loopback and measures the throughput of
+// the server as well as the latency between sending an event and its delivery to the user. Every
+// event is delivered to exactly one user. Latency includes the time events are held back by the
+// queue for ordering.
+func BenchmarkEndToEnd(b *testing.B) {
+	// Every connection is logged, which would break up the benchmark's results.
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+
+	s := NewLoopbackServer()
+	defer s.Close()
+
+	users := make([]*User, benchUsers)
+	for i := range users {
+		u, err := s.ConnectUser(strconv.Itoa(i + 1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer u.Close()
+		users[i] = u
+	}
+	es, err := s.ConnectEventSource()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	sent := make([]time.Time, b.N+1)
+	latencies := make([]time.Duration, b.N+1)
+	var wg sync.WaitGroup
+	for i, u := range users {
+		// Events are addressed to users in turn, so every user knows how many it gets.
+		n := b.N / benchUsers
+		if i < b.N%benchUsers {
+			n++
+		}
+		wg.Add(1)
+		go func(u *User, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				line, err := u.Next()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				received := time.Now()
+				seq, _ := strconv.Atoi(line[:strings.IndexByte(line, '|')])
+				latencies[seq] = received.Sub(sent[seq])
+			}
+		}(u, n)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	w := bufio.NewWriter(es.conn)
+	for seq := 1; seq <= b.N; seq++ {
+		sent[seq] = time.Now()
+		w.WriteString(strconv.Itoa(seq) + "|P|0|" + strconv.Itoa((seq-1)%benchUsers+1) + "\n")
+		if seq%benchBatchSize == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	es.Close()
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	sort.Slice(latencies[1:], func(i, j int) bool { return latencies[i+1] < latencies[j+1] })
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "events/s")
+	b.ReportMetric(float64(latencies[1+(b.N-1)/2]), "p50-ns")
+	b.ReportMetric(float64(latencies[1+(b.N-1)*99/100]), "p99-ns")
+}
@@ -0,0 +1,288 @@
+// Package mazetest runs a complete server on an in-memory network for integration tests. It
+// exposes helpers for connecting fake event sources and user clients and for awaiting the
+// notifications delivered to users, without real sockets or sleeping.
+package mazetest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johananl/follower-maze/events"
+	"github.com/johananl/follower-maze/memnet"
+	"github.com/johananl/follower-maze/userclients"
+)
+
+// Addresses the server listens on. They match the ports of a real server.
+const (
+	EventAddr = "localhost:9090"
+	UserAddr  = "localhost:9099"
+)
+
+// DefaultTimeout bounds waiting for notifications. It only guards against hanging tests: waiting
+// returns as soon as a notification is delivered.
+const DefaultTimeout = 5 * time.Second
+
+// Server is a server running on an in-memory network, or on the loopback interface.
+type Server struct {
+	Network *memnet.Network // Nil for loopback servers
+	Users   *userclients.UserHandler
+	Events  *events.EventHandler
+
+	dial       func(address string) (net.Conn, error)
+	stopEvents chan<- bool
+	stopUsers  chan<- bool
+}
+
+// start starts a server whose listeners are created by listen, and waits until the channels
+// returned by ready are closed.
+func start(listen func(network, address string) (net.Listener, error), ready func(address string) <-chan struct{}) *Server {
+	uh := userclients.NewUserHandler()
+	uh.SetListenFunc(listen)
+	eh := events.NewEventHandler(events.NewQueueManager(), uh)
+	eh.SetListenFunc(listen)
+
+	s := &Server{Users: uh, Events: eh}
+	eventsReady, usersReady := ready(EventAddr), ready(UserAddr)
+	s.stopEvents = eh.Run()
+	s.stopUsers = uh.Run()
+	<-eventsReady
+	<-usersReady
+
+	return s
+}
+
+// NewServer starts a server on a new in-memory network and returns once it is listening for both
+// event sources and user clients.
+func NewServer() *Server {
+	n := memnet.NewNetwork()
+	s := start(n.Listen, n.Listening)
+	s.Network = n
+	s.dial = n.Dial
+
+	return s
+}
+
+// NewLoopbackServer starts a server which listens on random ports of the loopback interface, so
+// that it doesn't conflict with a running server. It is meant for benchmarks which should include
+// the cost of real sockets. Connections are dialed to the random ports transparently.
+func NewLoopbackServer() *Server {
+	var lock sync.Mutex
+	addrs := make(map[string]string)
+	listening := map[string]chan struct{}{
+		EventAddr: make(chan struct{}),
+		UserAddr:  make(chan struct{}),
+	}
+
+	listen := func(network, address string) (net.Listener, error) {
+		l, err := net.Listen(network, "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		addrs[address] = l.Addr().String()
+		if ch, ok := listening[address]; ok {
+			close(ch)
+			delete(listening, address)
+		}
+		return l, nil
+	}
+	ready := func(address string) <-chan struct{} {
+		lock.Lock()
+		defer lock.Unlock()
+		return listening[address]
+	}
+
+	s := start(listen, ready)
+	s.dial = func(address string) (net.Conn, error) {
+		lock.Lock()
+		actual, ok := addrs[address]
+		lock.Unlock()
+		if !ok {
+			return nil, errors.New("mazetest: not listening on " + address)
+		}
+		return net.Dial("tcp", actual)
+	}
+
+	return s
+}
+
+// Close stops the server and returns once its handlers are done.
+func (s *Server) Close() {
+	s.stopEvents <- true
+	s.Events.Wait()
+	s.stopUsers <- true
+	s.Users.Wait()
+}
+
+// User is a fake user client. In-memory connections are unbuffered, so once identified, users read
+// notifications eagerly in the background, like a socket's receive buffer would. Otherwise the
+// server would block while notifying a user the test doesn't wait for yet.
+type User struct {
+	ID   int
+	conn net.Conn
+	br   *bufio.Reader
+
+	lock     sync.Mutex
+	received []string
+	err      error         // Error which stopped the background reader
+	signal   chan struct{} // Signaled whenever a notification is received or the reader stops
+}
+
+// ConnectUser connects a user client and identifies it with the given handshake line, e.g. "12" or
+// "12 types=F,P". It returns once the server has registered the user, so no notification sent
+// afterwards is missed.
+func (s *Server) ConnectUser(handshake string) (*User, error) {
+	id, err := strconv.Atoi(strings.Fields(handshake + " x")[0])
+	if err != nil {
+		return nil, errors.New("mazetest: invalid user ID in handshake " + handshake)
+	}
+	conn, err := s.dial(UserAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{ID: id, conn: conn, br: bufio.NewReader(conn), signal: make(chan struct{}, 1)}
+	if err := u.roundTrip(handshake + "\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	go u.read()
+
+	return u, nil
+}
+
+// roundTrip sends data followed by a command and waits for the command's response. Commands are
+// only answered after the preceding lines have been handled.
+func (u *User) roundTrip(data string) error {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := u.conn.Write([]byte(data + "?FOLLOWERS\n"))
+		errs <- err
+	}()
+
+	u.conn.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	for {
+		line, err := u.br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "?FOLLOWERS") {
+			return <-errs
+		}
+	}
+}
+
+// read receives notifications in the background until the connection is closed. Command
+// responses are skipped.
+func (u *User) read() {
+	for {
+		line, err := u.br.ReadString('\n')
+
+		u.lock.Lock()
+		if err != nil {
+			u.err = err
+		} else if !strings.HasPrefix(line, "?") {
+			u.received = append(u.received, line)
+		}
+		u.lock.Unlock()
+
+		select {
+		case u.signal <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Next waits for the next notification delivered to the user and returns it, including its
+// trailing newline.
+func (u *User) Next() (string, error) {
+	timeout := time.After(DefaultTimeout)
+	for {
+		u.lock.Lock()
+		if len(u.received) > 0 {
+			line := u.received[0]
+			u.received = u.received[1:]
+			u.lock.Unlock()
+			return line, nil
+		}
+		err := u.err
+		u.lock.Unlock()
+		if err != nil {
+			return "", err
+		}
+
+		select {
+		case <-u.signal:
+		case <-timeout:
+			return "", errors.New("timed out")
+		}
+	}
+}
+
+// Await waits for the given notifications to be delivered to the user, in order. It fails on the
+// first notification which differs.
+func (u *User) Await(notifications ...string) error {
+	for _, want := range notifications {
+		got, err := u.Next()
+		if err != nil {
+			return errors.New("mazetest: user " + strconv.Itoa(u.ID) + ": waiting for " +
+				strconv.Quote(want) + ": " + err.Error())
+		}
+		if got != want {
+			return errors.New("mazetest: user " + strconv.Itoa(u.ID) + ": got " + strconv.Quote(got) +
+				", want " + strconv.Quote(want))
+		}
+	}
+
+	return nil
+}
+
+// Close disconnects the user client.
+func (u *User) Close() error {
+	return u.conn.Close()
+}
+
+// EventSource is a fake event source.
+type EventSource struct {
+	conn net.Conn
+}
+
+// ConnectEventSource connects an event source.
+func (s *Server) ConnectEventSource() (*EventSource, error) {
+	conn, err := s.dial(EventAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventSource{conn}, nil
+}
+
+// Send sends events to the server. A trailing newline is added to events which lack one. Send
+// returns once the server has read the events.
+func (es *EventSource) Send(events ...string) error {
+	var b strings.Builder
+	for _, e := range events {
+		b.WriteString(e)
+		if !strings.HasSuffix(e, "\n") {
+			b.WriteString("\n")
+		}
+	}
+
+	_, err := es.conn.Write([]byte(b.String()))
+	return err
+}
+
+// Close disconnects the event source, which makes the server deliver any events left in its queue.
+func (es *EventSource) Close() error {
+	return es.conn.Close()
+}
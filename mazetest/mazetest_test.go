@@ -0,0 +1,74 @@
+package mazetest
+
+import "testing"
+
+// TestDelivery runs the original event types through a complete server and ensures that every
+// user receives exactly its notifications, in sequence order, even if events are sent out of order.
+func TestDelivery(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	alice, err := s.ConnectUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := s.ConnectUser("2 types=F,B,S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	es, err := s.ConnectEventSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = es.Send(
+		"3|S|1",
+		"1|F|2|1",
+		"2|F|1|2",
+		"5|P|1|2",
+		"4|B",
+		"6|U|2|1",
+		"7|S|1",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.Close()
+
+	if err := alice.Await("1|F|2|1\n", "4|B\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Await("2|F|1|2\n", "3|S|1\n", "4|B\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServersIndependent ensures that servers on different networks don't share state, so tests
+// using them may run in parallel.
+func TestServersIndependent(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			s := NewServer()
+			defer s.Close()
+
+			u, err := s.ConnectUser("7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			es, err := s.ConnectEventSource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			es.Send("2|P|1|7", "1|B")
+			es.Close()
+
+			if err := u.Await("1|B\n", "2|P|1|7\n"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
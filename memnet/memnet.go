@@ -0,0 +1,144 @@
+// Package memnet implements an in-memory network for tests. Listeners created on a Network accept
+// connections dialed on the same Network, without using real sockets. Connections are synchronous
+// in-memory pipes created by net.Pipe, so they support deadlines like TCP connections do.
+package memnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrClosed is returned by Accept once a listener has been closed.
+var ErrClosed = errors.New("memnet: listener closed")
+
+// Addr is the address of an in-memory listener.
+type Addr string
+
+// Network returns the name of the network.
+func (a Addr) Network() string { return "memnet" }
+
+func (a Addr) String() string { return string(a) }
+
+// Network is an in-memory network mapping addresses to listeners. It is safe for concurrent use.
+type Network struct {
+	lock      sync.Mutex
+	listeners map[string]*Listener
+	listening map[string]chan struct{}
+}
+
+// NewNetwork constructs a new Network and returns a pointer to it.
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[string]*Listener),
+		listening: make(map[string]chan struct{}),
+	}
+}
+
+// ready returns the channel which is closed once address is listened on. It must be called while
+// holding the network's lock.
+func (n *Network) ready(address string) chan struct{} {
+	ch, ok := n.listening[address]
+	if !ok {
+		ch = make(chan struct{})
+		n.listening[address] = ch
+	}
+
+	return ch
+}
+
+// Listen creates a listener on the given address. Its signature matches net.Listen so that it can
+// be injected wherever a listen function is expected. The network name is ignored.
+func (n *Network) Listen(network, address string) (net.Listener, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.listeners[address]; ok {
+		return nil, errors.New("memnet: address already in use: " + address)
+	}
+	l := &Listener{
+		network: n,
+		addr:    Addr(address),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[address] = l
+
+	ch := n.ready(address)
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+
+	return l, nil
+}
+
+// Listening returns a channel which is closed once a listener has been created on address. It
+// allows tests to wait for a server to start listening without sleeping.
+func (n *Network) Listening(address string) <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.ready(address)
+}
+
+// Dial connects to the listener on the given address. It blocks until the listener accepts the
+// connection and fails if no listener exists or the listener is closed before accepting.
+func (n *Network) Dial(address string) (net.Conn, error) {
+	n.lock.Lock()
+	l, ok := n.listeners[address]
+	n.lock.Unlock()
+	if !ok {
+		return nil, errors.New("memnet: connection refused: " + address)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, errors.New("memnet: connection refused: " + address)
+	}
+}
+
+// Listener is an in-memory net.Listener.
+type Listener struct {
+	network *Network
+	addr    Addr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Accept waits for and returns the next connection dialed to the listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close closes the listener and frees its address. Connections which were already accepted aren't
+// affected.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+
+		l.network.lock.Lock()
+		defer l.network.lock.Unlock()
+		delete(l.network.listeners, string(l.addr))
+		delete(l.network.listening, string(l.addr))
+	})
+
+	return nil
+}
+
+// Addr returns the listener's address.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
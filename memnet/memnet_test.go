@@ -0,0 +1,53 @@
+package memnet
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestDialAccept(t *testing.T) {
+	n := NewNetwork()
+	ready := n.Listening("a:1")
+
+	if _, err := n.Dial("a:1"); err == nil {
+		t.Fatal("Dial succeeded without a listener")
+	}
+
+	l, err := n.Listen("tcp", "a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ready
+	if _, err := n.Listen("tcp", "a:1"); err == nil {
+		t.Fatal("Listened twice on the same address")
+	}
+
+	go func() {
+		c, err := n.Dial("a:1")
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hi"))
+		c.Close()
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(c)
+	if string(b) != "hi" {
+		t.Fatalf("Invalid data: got %q, want %q", b, "hi")
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err != ErrClosed {
+		t.Fatalf("Invalid error after close: got %v, want %v", err, ErrClosed)
+	}
+	if _, err := n.Dial("a:1"); err == nil {
+		t.Fatal("Dial succeeded after the listener was closed")
+	}
+	if _, err := n.Listen("tcp", "a:1"); err != nil {
+		t.Fatal("Address not freed after close:", err)
+	}
+}
@@ -0,0 +1,182 @@
+package followermaze
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/johananl/follower-maze/events"
+	"github.com/johananl/follower-maze/userclients"
+)
+
+// Option configures a Server. Options are passed to New.
+type Option func(*Server) error
+
+// WithListenFunc replaces the function used for creating the server's listeners, which is
+// net.Listen by default. Tests may pass the Listen method of a memnet.Network.
+func WithListenFunc(f func(network, address string) (net.Listener, error)) Option {
+	return func(s *Server) error {
+		if f == nil {
+			return errors.New("followermaze: nil listen function")
+		}
+		s.listenFunc = f
+		return nil
+	}
+}
+
+// addrOption returns an option which listens on addr instead of the default address def.
+func addrOption(def, addr string) Option {
+	return func(s *Server) error {
+		if addr == "" {
+			return errors.New("followermaze: empty address in place of " + def)
+		}
+		s.addrs[def] = addr
+		return nil
+	}
+}
+
+// WithEventAddr makes the server listen for event sources on addr instead of EventAddr.
+func WithEventAddr(addr string) Option {
+	return addrOption(EventAddr, addr)
+}
+
+// WithEventHTTPAddr makes the server accept event batches on addr instead of EventHTTPAddr.
+func WithEventHTTPAddr(addr string) Option {
+	return addrOption(EventHTTPAddr, addr)
+}
+
+// WithUserAddr makes the server listen for user clients on addr instead of UserAddr.
+func WithUserAddr(addr string) Option {
+	return addrOption(UserAddr, addr)
+}
+
+// WithUserHTTPAddr makes the server accept HTTP user clients on addr instead of UserHTTPAddr.
+func WithUserHTTPAddr(addr string) Option {
+	return addrOption(UserHTTPAddr, addr)
+}
+
+// WithHTTP makes the server accept event batches and HTTP user clients on EventHTTPAddr and
+// UserHTTPAddr, or on the addresses configured by WithEventHTTPAddr and WithUserHTTPAddr.
+func WithHTTP() Option {
+	return func(s *Server) error {
+		s.http = true
+		return nil
+	}
+}
+
+// WithEventTLS makes the server accept event sources over TLS only.
+func WithEventTLS(config *tls.Config) Option {
+	return func(s *Server) error {
+		s.events.SetTLSConfig(config)
+		return nil
+	}
+}
+
+// WithUserTLS makes the server accept user clients over TLS only.
+func WithUserTLS(config *tls.Config) Option {
+	return func(s *Server) error {
+		s.users.SetTLSConfig(config)
+		return nil
+	}
+}
+
+// WithAuthenticator replaces the authenticator of user clients, which accepts any user ID by
+// default.
+func WithAuthenticator(a userclients.Authenticator) Option {
+	return func(s *Server) error {
+		if a == nil {
+			return errors.New("followermaze: nil authenticator")
+		}
+		s.users.SetAuthenticator(a)
+		return nil
+	}
+}
+
+// WithRouter replaces the router used for parsing and routing events.
+func WithRouter(r *events.Router) Option {
+	return func(s *Server) error {
+		if r == nil {
+			return errors.New("followermaze: nil router")
+		}
+		s.events.SetRouter(r)
+		return nil
+	}
+}
+
+// WithGraph replaces the graph used for storing follow relationships.
+func WithGraph(g userclients.Graph) Option {
+	return func(s *Server) error {
+		if g == nil {
+			return errors.New("followermaze: nil graph")
+		}
+		s.users.SetGraph(g)
+		return nil
+	}
+}
+
+// WithRecorder records the traffic of event sources to w, in the format read by Server.Replay.
+func WithRecorder(w io.Writer) Option {
+	return func(s *Server) error {
+		s.events.SetRecorder(events.NewRecorder(w))
+		return nil
+	}
+}
+
+// WithHandshakeLimits sets the time a TCP user client has for identifying and the number of
+// handshakes which may be pending at once. A zero timeout disables the handshake deadline.
+func WithHandshakeLimits(timeout time.Duration, maxPending int) Option {
+	return func(s *Server) error {
+		return s.users.SetHandshakeLimits(timeout, maxPending)
+	}
+}
+
+// WithWebhook POSTs notifications of users who aren't connected to a webhook, which is configured
+// by config. The webhook sink runs while the server does, and once the server stops it sends the
+// notifications left for at most config.DrainTimeout.
+func WithWebhook(config userclients.WebhookConfig) Option {
+	return func(s *Server) error {
+		sink, err := userclients.NewWebhookSink(config)
+		if err != nil {
+			return err
+		}
+		s.users.SetUndeliveredSink(sink)
+		s.webhook = sink
+		return nil
+	}
+}
+
+// OnEvent sets a function which is called with every event, in sequence order, before it is
+// routed. It holds up event processing, so it should return quickly.
+func OnEvent(f func(e Event)) Option {
+	return func(s *Server) error {
+		s.events.SetEventHook(f)
+		return nil
+	}
+}
+
+// OnDeliver sets a function which is called after a notification has been written to a user's
+// connection.
+func OnDeliver(f func(id int, notification string)) Option {
+	return func(s *Server) error {
+		s.hooks.OnDeliver = f
+		return nil
+	}
+}
+
+// OnConnect sets a function which is called once a user has connected and identified.
+func OnConnect(f func(id int)) Option {
+	return func(s *Server) error {
+		s.hooks.OnConnect = f
+		return nil
+	}
+}
+
+// OnDisconnect sets a function which is called once a user has disconnected.
+func OnDisconnect(f func(id int)) Option {
+	return func(s *Server) error {
+		s.hooks.OnDisconnect = f
+		return nil
+	}
+}
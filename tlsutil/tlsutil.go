@@ -0,0 +1,82 @@
+// Package tlsutil builds TLS configurations for the server's listeners. Certificates are loaded
+// through a CertReloader so that they can be replaced at runtime without restarting the server.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// CertReloader holds a certificate/key pair loaded from disk. Reload reads the files again, which
+// allows rotating certificates while the server is running. New TLS handshakes use the most
+// recently loaded certificate while existing connections are unaffected.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	lock     sync.RWMutex
+}
+
+// Reload reads the certificate/key pair from disk. The previous certificate is kept if loading
+// fails.
+func (cr *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	cr.cert = &cert
+	log.Println("Loaded TLS certificate from " + cr.certFile)
+
+	return nil
+}
+
+// GetCertificate returns the current certificate. It is meant to be used as the GetCertificate
+// field of a tls.Config.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.RLock()
+	defer cr.lock.RUnlock()
+	return cr.cert, nil
+}
+
+// NewCertReloader constructs a new CertReloader, loads the certificate/key pair and returns a
+// pointer to the CertReloader.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// NewServerConfig returns a TLS configuration which serves the certificate held by cr. If
+// clientCAFile isn't empty, clients are required to present a certificate signed by one of the
+// CAs in that file (mutual TLS).
+func NewServerConfig(cr *CertReloader, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,181 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateCert creates a certificate for commonName signed by parent (or self-signed if parent is
+// nil) and returns it along with its key.
+func generateCert(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// writePEM writes a certificate and its key to PEM files in dir.
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, firstKey := generateCert(t, "first", false, nil, nil)
+	certFile, keyFile := writePEM(t, dir, "server", first, firstKey)
+
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, secondKey := generateCert(t, "second", false, nil, nil)
+	writePEM(t, dir, "server", second, secondKey)
+	if err := cr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := cr.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "second" {
+		t.Fatalf("Certificate not reloaded: got %v, want %v", leaf.Subject.CommonName, "second")
+	}
+
+	// A failed reload should keep the current certificate.
+	os.Remove(keyFile)
+	if err := cr.Reload(); err == nil {
+		t.Fatal("Expected reloading a missing key to fail")
+	}
+	if c, _ := cr.GetCertificate(nil); c != cert {
+		t.Fatal("Certificate replaced after a failed reload")
+	}
+}
+
+// TestMutualTLS ensures that a config with a client CA only accepts clients presenting a
+// certificate signed by that CA.
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := generateCert(t, "ca", true, nil, nil)
+	caFile, _ := writePEM(t, dir, "ca", ca, caKey)
+	server, serverKey := generateCert(t, "server", false, ca, caKey)
+	certFile, keyFile := writePEM(t, dir, "server", server, serverKey)
+	client, clientKey := generateCert(t, "client", false, ca, caKey)
+
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewServerConfig(cr, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Only clients which complete the handshake receive a byte.
+			if conn.(*tls.Conn).Handshake() == nil {
+				conn.Write([]byte("x"))
+			}
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// A client presenting a certificate signed by the CA is accepted.
+	clientCert := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A client without a certificate is rejected. With TLS 1.3 the rejection is only reported
+	// when reading from the connection.
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("Expected a client without a certificate to be rejected")
+	}
+}
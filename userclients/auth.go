@@ -0,0 +1,140 @@
+package userclients
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrAuthenticationFailed is returned by authenticators when a user client's credentials are
+// invalid.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// Authenticator verifies the credentials sent by a user client during the handshake and returns the
+// ID of the authenticated user. Connections whose credentials fail to authenticate are rejected.
+type Authenticator interface {
+	Authenticate(credentials string) (int, error)
+}
+
+// IDAuthenticator trusts the user ID sent by the client. It is the default authenticator and
+// implements the original, unauthenticated protocol.
+type IDAuthenticator struct{}
+
+// Authenticate parses the credentials as a user ID.
+func (IDAuthenticator) Authenticate(credentials string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(credentials))
+}
+
+// splitCredentials splits credentials of the form ID:token.
+func splitCredentials(credentials string) (int, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(credentials), ":", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrAuthenticationFailed
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", ErrAuthenticationFailed
+	}
+
+	return id, parts[1], nil
+}
+
+// HMACAuthenticator authenticates credentials of the form ID:token, where token is the hex-encoded
+// HMAC-SHA256 of the user ID computed with a secret shared with whoever issues the tokens.
+type HMACAuthenticator struct {
+	secret []byte
+}
+
+// Authenticate verifies the token against the user ID.
+func (a *HMACAuthenticator) Authenticate(credentials string) (int, error) {
+	id, token, err := splitCredentials(credentials)
+	if err != nil {
+		return 0, err
+	}
+
+	mac, err := hex.DecodeString(token)
+	if err != nil || !hmac.Equal(mac, a.mac(id)) {
+		return 0, ErrAuthenticationFailed
+	}
+
+	return id, nil
+}
+
+// mac computes the HMAC of a user ID.
+func (a *HMACAuthenticator) mac(id int) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write([]byte(strconv.Itoa(id)))
+
+	return h.Sum(nil)
+}
+
+// Token returns the token a user client should send in order to authenticate as the given user.
+func (a *HMACAuthenticator) Token(id int) string {
+	return hex.EncodeToString(a.mac(id))
+}
+
+// NewHMACAuthenticator constructs a new HMACAuthenticator and returns a pointer to it.
+func NewHMACAuthenticator(secret []byte) *HMACAuthenticator {
+	return &HMACAuthenticator{secret}
+}
+
+// TokenFileAuthenticator authenticates credentials of the form ID:token against a static list of
+// tokens.
+type TokenFileAuthenticator struct {
+	tokens map[int]string
+}
+
+// Authenticate verifies the token against the token listed for the user ID.
+func (a *TokenFileAuthenticator) Authenticate(credentials string) (int, error) {
+	id, token, err := splitCredentials(credentials)
+	if err != nil {
+		return 0, err
+	}
+
+	want, ok := a.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		return 0, ErrAuthenticationFailed
+	}
+
+	return id, nil
+}
+
+// NewTokenFileAuthenticator constructs a new TokenFileAuthenticator and returns a pointer to it. The
+// file holds one "ID token" pair per line. Empty lines and lines starting with # are ignored.
+func NewTokenFileAuthenticator(path string) (*TokenFileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[int]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": expected an ID and a token")
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(n) + ": invalid user ID " + fields[0])
+		}
+		tokens[id] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return &TokenFileAuthenticator{tokens}, nil
+}
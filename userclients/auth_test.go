@@ -0,0 +1,77 @@
+package userclients
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	a := NewHMACAuthenticator([]byte("secret"))
+
+	id, err := a.Authenticate("2932:" + a.Token(2932) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2932 {
+		t.Fatalf("Invalid user ID: got %d, want %d", id, 2932)
+	}
+
+	for _, c := range []string{
+		"2932",
+		"2932:",
+		"2933:" + a.Token(2932),
+		"2932:" + NewHMACAuthenticator([]byte("other")).Token(2932),
+		"2932:not-hex",
+		"abc:" + a.Token(2932),
+	} {
+		if _, err := a.Authenticate(c); err == nil {
+			t.Fatalf("Expected credentials %q to be rejected", c)
+		}
+	}
+}
+
+func TestTokenFileAuthenticator(t *testing.T) {
+	f, err := ioutil.TempFile("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# Tokens for testing\n2932 abc\n\n17 def\n")
+	f.Close()
+
+	a, err := NewTokenFileAuthenticator(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := a.Authenticate("17:def\n"); err != nil || id != 17 {
+		t.Fatalf("Valid credentials rejected: got %d, %v", id, err)
+	}
+	for _, c := range []string{"17:abc", "18:def", "17", "2932:abcd"} {
+		if _, err := a.Authenticate(c); err == nil {
+			t.Fatalf("Expected credentials %q to be rejected", c)
+		}
+	}
+}
+
+// TestHandleUserRejected ensures that handleUser closes connections which fail to authenticate
+// without returning a User.
+func TestHandleUserRejected(t *testing.T) {
+	uh := NewUserHandler()
+	uh.SetAuthenticator(NewHMACAuthenticator([]byte("secret")))
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ch := uh.handleUser(server)
+	client.Write([]byte("123\n"))
+
+	if u, ok := <-ch; ok {
+		t.Fatalf("Unauthenticated user returned: %v", u.id)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
@@ -0,0 +1,78 @@
+package userclients
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Sizes of the benchmarked population, matching the defaults of the followermaze harness
+const (
+	benchUsers     = 1000
+	benchConnected = 100
+	benchFollows   = 20 // Average number of users every user follows
+)
+
+// newBenchHandler returns a user handler with connected users and follow relationships following
+// a power law: a few users have many followers while most have few, like in real social networks.
+// It also returns a source of authors which is skewed in the same way, since popular users tend to
+// post more.
+func newBenchHandler() (*UserHandler, func() int) {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.2, 1, benchUsers-1)
+
+	uh := NewUserHandler()
+	for id := 0; id < benchConnected; id++ {
+		uh.registerUser(User{id: id, connection: discardConn{}})
+	}
+	for from := 0; from < benchUsers; from++ {
+		for i := 0; i < benchFollows; i++ {
+			if to := int(zipf.Uint64()); to != from {
+				uh.Follow(from, to)
+			}
+		}
+	}
+
+	return uh, func() int { return int(zipf.Uint64()) }
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	uh, _ := newBenchHandler()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		uh.ForEachConnected(func(id int) {
+			uh.NotifyUser(id, "1|B\n")
+		})
+	}
+}
+
+func BenchmarkStatusUpdate(b *testing.B) {
+	uh, author := newBenchHandler()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, id := range uh.FollowersSnapshot(author()) {
+			uh.NotifyUser(id, "1|S|1\n")
+		}
+	}
+}
+
+// BenchmarkStatusUpdateParallel measures status updates fanned out concurrently, which exercises
+// the sharded locks of the registry and the graph.
+func BenchmarkStatusUpdateParallel(b *testing.B) {
+	uh, _ := newBenchHandler()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		zipf := rand.NewZipf(r, 1.2, 1, benchUsers-1)
+		for pb.Next() {
+			for _, id := range uh.FollowersSnapshot(int(zipf.Uint64())) {
+				uh.NotifyUser(id, "1|S|1\n")
+			}
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package userclients
+
+import (
+	"strconv"
+	"strings"
+)
+
+// commandPrefix starts every command sent by user clients as well as every response sent back.
+// Notifications always start with a sequence number, so clients can tell responses apart from
+// notifications by their first character.
+const commandPrefix = "?"
+
+// Commands which user clients may send after identifying
+const (
+	followersCommand = "FOLLOWERS"
+	followingCommand = "FOLLOWING"
+	mutualsCommand   = "MUTUALS"
+	identifyCommand  = "IDENTIFY"
+	errorResponse    = "ERROR"
+)
+
+// isCommand reports whether a line sent by a user client is a command.
+func isCommand(line string) bool {
+	return strings.HasPrefix(line, commandPrefix)
+}
+
+// isIdentifyCommand reports whether a line sent by a user client is a re-identify command, e.g.
+// "?IDENTIFY 2933 types=F". Re-identification changes the connection's state, so it is handled by
+// the connection's handler rather than by handleCommand.
+func isIdentifyCommand(line string) bool {
+	fields := strings.Fields(strings.TrimPrefix(line, commandPrefix))
+	return isCommand(line) && len(fields) > 0 && strings.ToUpper(fields[0]) == identifyCommand
+}
+
+// identifyCredentials returns the handshake carried by a re-identify command.
+func identifyCredentials(line string) string {
+	line = strings.TrimSpace(strings.TrimPrefix(line, commandPrefix))
+	return strings.TrimSpace(line[len(identifyCommand):])
+}
+
+// formatIDs formats a list of user IDs as a comma-separated string.
+func formatIDs(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+
+	return strings.Join(s, ",")
+}
+
+// intersect returns the elements of a which are also in b, in the order in which they appear in a.
+func intersect(a, b []int) []int {
+	set := make(map[int]bool, len(b))
+	for _, x := range b {
+		set[x] = true
+	}
+
+	result := []int{}
+	for _, x := range a {
+		if set[x] {
+			result = append(result, x)
+		}
+	}
+
+	return result
+}
+
+// handleCommand answers a command sent by the given user and returns the response. Every response
+// is a single line which echoes the command's name, followed by its result:
+//
+//	?FOLLOWERS           ->  ?FOLLOWERS|<followers of the user>
+//	?FOLLOWING           ->  ?FOLLOWING|<users followed by the user>
+//	?MUTUALS             ->  ?MUTUALS|<users who both follow and are followed by the user>
+//	?MUTUALS <id>        ->  ?MUTUALS|<id>|<users who follow both the user and id>
+//
+// Invalid commands are answered with ?ERROR|<reason>. Responses are written to the connection with
+// a single Write, just like notifications, so the two never interleave mid-line.
+func (uh *UserHandler) handleCommand(id int, line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, commandPrefix))
+	if len(fields) == 0 {
+		return commandPrefix + errorResponse + "|empty command\n"
+	}
+
+	name, args := strings.ToUpper(fields[0]), fields[1:]
+	switch {
+	case name == followersCommand && len(args) == 0:
+		return commandPrefix + name + "|" + formatIDs(uh.FollowersSnapshot(id)) + "\n"
+	case name == followingCommand && len(args) == 0:
+		return commandPrefix + name + "|" + formatIDs(uh.Following(id)) + "\n"
+	case name == mutualsCommand && len(args) == 0:
+		mutuals := intersect(uh.FollowersSnapshot(id), uh.Following(id))
+		return commandPrefix + name + "|" + formatIDs(mutuals) + "\n"
+	case name == mutualsCommand && len(args) == 1:
+		other, err := strconv.Atoi(args[0])
+		if err != nil {
+			return commandPrefix + errorResponse + "|invalid user ID " + args[0] + "\n"
+		}
+		mutuals := intersect(uh.FollowersSnapshot(id), uh.FollowersSnapshot(other))
+		return commandPrefix + name + "|" + args[0] + "|" + formatIDs(mutuals) + "\n"
+	default:
+		return commandPrefix + errorResponse + "|invalid command " + strings.Join(fields, " ") + "\n"
+	}
+}
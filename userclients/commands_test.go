@@ -0,0 +1,61 @@
+package userclients
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+var commands = []struct {
+	in  string
+	out string
+}{
+	{"?FOLLOWERS\n", "?FOLLOWERS|2,3,4\n"},
+	{"?following\n", "?FOLLOWING|3,5\n"},
+	{"?MUTUALS\n", "?MUTUALS|3\n"},
+	{"?MUTUALS 6\n", "?MUTUALS|6|2,4\n"},
+	{"?MUTUALS 7\n", "?MUTUALS|7|\n"},
+	{"?MUTUALS abc\n", "?ERROR|invalid user ID abc\n"},
+	{"?FOLLOWERS 1 2\n", "?ERROR|invalid command FOLLOWERS 1 2\n"},
+	{"?\n", "?ERROR|empty command\n"},
+}
+
+func TestHandleCommand(t *testing.T) {
+	uh := NewUserHandler()
+	for _, f := range []int{2, 3, 4} {
+		uh.Follow(f, 1)
+	}
+	uh.Follow(1, 3)
+	uh.Follow(1, 5)
+	uh.Follow(4, 6)
+	uh.Follow(2, 6)
+
+	for _, tc := range commands {
+		if got := uh.handleCommand(1, tc.in); got != tc.out {
+			t.Fatalf("Invalid response to %q: got %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+// TestHandleUserCommands ensures that commands sent over a user connection after identifying are
+// answered on the same connection.
+func TestHandleUserCommands(t *testing.T) {
+	uh := NewUserHandler()
+	uh.Follow(8, 9)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ch := uh.handleUser(server)
+	client.Write([]byte("9\n"))
+	<-ch
+
+	go client.Write([]byte("?FOLLOWERS\n"))
+	response, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "?FOLLOWERS|8\n" {
+		t.Fatalf("Invalid response: got %q, want %q", response, "?FOLLOWERS|8\n")
+	}
+}
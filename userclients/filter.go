@@ -0,0 +1,74 @@
+package userclients
+
+import (
+	"errors"
+	"strings"
+)
+
+// typesOption is the handshake option which restricts the event types a user client receives.
+const typesOption = "types"
+
+// typeFilter holds the event types a user client wants to receive. A nil filter allows all types.
+type typeFilter map[string]bool
+
+// allows reports whether a notification should be sent to a client with the filter.
+func (f typeFilter) allows(message string) bool {
+	if f == nil {
+		return true
+	}
+
+	return f[eventTypeOf(message)]
+}
+
+// eventTypeOf extracts the type code from a raw event, which is the field following the sequence.
+func eventTypeOf(message string) string {
+	message = strings.TrimRight(message, "\r\n")
+	i := strings.IndexByte(message, '|')
+	if i < 0 {
+		return ""
+	}
+	message = message[i+1:]
+	if j := strings.IndexByte(message, '|'); j >= 0 {
+		message = message[:j]
+	}
+
+	return message
+}
+
+// parseTypeFilter parses a comma-separated list of event types, e.g. F,P.
+func parseTypeFilter(types string) (typeFilter, error) {
+	f := make(typeFilter)
+	for _, t := range strings.Split(types, ",") {
+		if t == "" {
+			return nil, errors.New("empty event type in filter")
+		}
+		f[t] = true
+	}
+
+	return f, nil
+}
+
+// parseHandshake splits a handshake line into the client's credentials and the options following
+// them, e.g. "2932 types=F,P". The only supported option is types, which sets the event types the
+// client receives.
+func parseHandshake(line string) (string, typeFilter, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, errors.New("empty handshake")
+	}
+
+	var filter typeFilter
+	for _, option := range fields[1:] {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || kv[0] != typesOption {
+			return "", nil, errors.New("invalid handshake option " + option)
+		}
+
+		var err error
+		if filter, err = parseTypeFilter(kv[1]); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return fields[0], filter, nil
+}
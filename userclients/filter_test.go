@@ -0,0 +1,69 @@
+package userclients
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseHandshake(t *testing.T) {
+	credentials, filter, err := parseHandshake("2932:abc types=F,P\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials != "2932:abc" {
+		t.Fatalf("Invalid credentials: got %q, want %q", credentials, "2932:abc")
+	}
+	if want := (typeFilter{"F": true, "P": true}); !reflect.DeepEqual(filter, want) {
+		t.Fatalf("Invalid filter: got %v, want %v", filter, want)
+	}
+
+	if _, filter, _ := parseHandshake("2932\n"); filter != nil {
+		t.Fatalf("Expected no filter, got %v", filter)
+	}
+
+	for _, h := range []string{"", "\n", "2932 types=", "2932 types=F,,P", "2932 foo=bar", "2932 types"} {
+		if _, _, err := parseHandshake(h); err == nil {
+			t.Fatalf("Expected handshake %q to be rejected", h)
+		}
+	}
+}
+
+func TestTypeFilter(t *testing.T) {
+	f := typeFilter{"P": true, "GM": true}
+	for message, want := range map[string]bool{
+		"43|P|32|56\n":  true,
+		"83|GM|1|500\n": true,
+		"542532|B\n":    false,
+		"634|S|32\n":    false,
+	} {
+		if got := f.allows(message); got != want {
+			t.Fatalf("Invalid filter result for %q: got %v, want %v", message, got, want)
+		}
+	}
+}
+
+// TestNotifyUserFiltered ensures that notifications excluded by a user's filter aren't sent.
+func TestNotifyUserFiltered(t *testing.T) {
+	uh := NewUserHandler()
+	client, server := net.Pipe()
+	defer client.Close()
+
+	ch := uh.handleUser(server)
+	go client.Write([]byte("5 types=P\n"))
+	uh.registerUser(<-ch)
+
+	go func() {
+		uh.NotifyUser(5, "1|B\n")
+		uh.NotifyUser(5, "2|P|3|5\n")
+	}()
+
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "2|P|3|5\n" {
+		t.Fatalf("Invalid notification: got %q, want %q", buf[:n], "2|P|3|5\n")
+	}
+}
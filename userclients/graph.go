@@ -0,0 +1,198 @@
+package userclients
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Graph stores follow relationships between users. Implementations must be safe for concurrent use.
+type Graph interface {
+	// Follow registers from as a follower of to. Following a user more than once has no effect.
+	Follow(from, to int)
+	// Unfollow removes from from the followers of to.
+	Unfollow(from, to int)
+	// Followers returns the followers of a user, in the order in which they started following.
+	Followers(id int) []int
+	// Following returns the users followed by a user, in the order in which they were followed.
+	Following(id int) []int
+}
+
+// intSet is a set of user IDs which preserves insertion order. Elements are kept in a linked list
+// for ordering and indexed by a map, so adding, removing and looking up elements are all O(1).
+type intSet struct {
+	index map[int]*list.Element
+	order *list.List
+}
+
+func newIntSet() *intSet {
+	return &intSet{index: make(map[int]*list.Element), order: list.New()}
+}
+
+// add inserts an element at the end of the set. It has no effect if the element is already in the
+// set.
+func (s *intSet) add(x int) {
+	if _, ok := s.index[x]; ok {
+		return
+	}
+	s.index[x] = s.order.PushBack(x)
+}
+
+// remove deletes an element from the set.
+func (s *intSet) remove(x int) {
+	if e, ok := s.index[x]; ok {
+		s.order.Remove(e)
+		delete(s.index, x)
+	}
+}
+
+// contains reports whether an element is in the set.
+func (s *intSet) contains(x int) bool {
+	_, ok := s.index[x]
+	return ok
+}
+
+// len returns the number of elements in the set.
+func (s *intSet) len() int {
+	return len(s.index)
+}
+
+// slice returns a copy of the set's elements in insertion order.
+func (s *intSet) slice() []int {
+	result := make([]int, 0, s.order.Len())
+	for e := s.order.Front(); e != nil; e = e.Next() {
+		result = append(result, e.Value.(int))
+	}
+
+	return result
+}
+
+// adjacency maps a user ID to a set of user IDs. It is used for both directions of the follow
+// graph.
+type adjacency map[int]*intSet
+
+// add inserts to into the set of from.
+func (a adjacency) add(from, to int) {
+	s, ok := a[from]
+	if !ok {
+		s = newIntSet()
+		a[from] = s
+	}
+	s.add(to)
+}
+
+// remove deletes to from the set of from. Empty sets are deleted to avoid accumulating memory for
+// users who no longer have any relationships.
+func (a adjacency) remove(from, to int) {
+	s, ok := a[from]
+	if !ok {
+		return
+	}
+	s.remove(to)
+	if s.len() == 0 {
+		delete(a, from)
+	}
+}
+
+// list returns a copy of the set of id.
+func (a adjacency) list(id int) []int {
+	s, ok := a[id]
+	if !ok {
+		return nil
+	}
+
+	return s.slice()
+}
+
+// graphShard holds both directions of the follow graph for the users whose IDs map to the shard.
+type graphShard struct {
+	followers adjacency
+	following adjacency
+	lock      sync.RWMutex
+}
+
+// setGraph is the default Graph implementation. Both the followers of every user and the users
+// every user follows are stored in insertion-ordered sets, which makes Follow idempotent and
+// Unfollow O(1). The graph is striped across shards keyed by user ID: the followers of a user are
+// stored in the user's shard, as are the users the user follows.
+type setGraph struct {
+	shards []*graphShard
+}
+
+// lockPair locks the shards holding the two sides of a relationship and returns a function which
+// unlocks them. Shards are always locked in index order to avoid deadlocks, so that both indexes
+// are updated atomically and never disagree.
+func (g *setGraph) lockPair(from, to int) (*graphShard, *graphShard, func()) {
+	i, j := shardIndex(from, len(g.shards)), shardIndex(to, len(g.shards))
+	fromShard, toShard := g.shards[i], g.shards[j]
+
+	if i == j {
+		fromShard.lock.Lock()
+		return fromShard, toShard, fromShard.lock.Unlock
+	}
+
+	first, second := fromShard, toShard
+	if j < i {
+		first, second = toShard, fromShard
+	}
+	first.lock.Lock()
+	second.lock.Lock()
+
+	return fromShard, toShard, func() {
+		second.lock.Unlock()
+		first.lock.Unlock()
+	}
+}
+
+// Follow registers from as a follower of to.
+func (g *setGraph) Follow(from, to int) {
+	fromShard, toShard, unlock := g.lockPair(from, to)
+	defer unlock()
+	toShard.followers.add(to, from)
+	fromShard.following.add(from, to)
+}
+
+// Unfollow removes from from the followers of to.
+func (g *setGraph) Unfollow(from, to int) {
+	fromShard, toShard, unlock := g.lockPair(from, to)
+	defer unlock()
+	toShard.followers.remove(to, from)
+	fromShard.following.remove(from, to)
+}
+
+// Followers returns a copy of the followers of a user.
+func (g *setGraph) Followers(id int) []int {
+	s := g.shards[shardIndex(id, len(g.shards))]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.followers.list(id)
+}
+
+// Following returns a copy of the users followed by a user.
+func (g *setGraph) Following(id int) []int {
+	s := g.shards[shardIndex(id, len(g.shards))]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.following.list(id)
+}
+
+// NewShardedGraph constructs a new set-based Graph striped across the given number of shards and
+// returns it. A graph has at least one shard, so fewer shards result in a single one.
+func NewShardedGraph(shards int) Graph {
+	if shards < 1 {
+		shards = 1
+	}
+	g := &setGraph{shards: make([]*graphShard, shards)}
+	for i := range g.shards {
+		g.shards[i] = &graphShard{
+			followers: make(adjacency),
+			following: make(adjacency),
+		}
+	}
+
+	return g
+}
+
+// NewSetGraph constructs a new set-based Graph with a single shard and returns it.
+func NewSetGraph() Graph {
+	return NewShardedGraph(1)
+}
@@ -0,0 +1,88 @@
+package userclients
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestFollowIdempotent ensures that repeated Follow events don't register a follower twice, which
+// would result in duplicate status update notifications.
+func TestFollowIdempotent(t *testing.T) {
+	g := NewSetGraph()
+
+	g.Follow(1, 10)
+	g.Follow(2, 10)
+	g.Follow(1, 10)
+	g.Follow(3, 10)
+
+	if got, want := g.Followers(10), []int{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid followers: got %v, want %v", got, want)
+	}
+	if got, want := g.Following(1), []int{10}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid following: got %v, want %v", got, want)
+	}
+}
+
+func TestUnfollow(t *testing.T) {
+	g := NewSetGraph()
+
+	g.Follow(1, 10)
+	g.Follow(2, 10)
+	g.Follow(3, 10)
+	g.Follow(2, 20)
+
+	g.Unfollow(2, 10)
+	// Unfollowing a user who isn't followed has no effect.
+	g.Unfollow(4, 10)
+
+	if got, want := g.Followers(10), []int{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid followers: got %v, want %v", got, want)
+	}
+	if got, want := g.Following(2), []int{20}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid following: got %v, want %v", got, want)
+	}
+
+	// Following again after unfollowing moves the follower to the end.
+	g.Follow(2, 10)
+	if got, want := g.Followers(10), []int{1, 3, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid followers: got %v, want %v", got, want)
+	}
+}
+
+// TestFollowersCopy ensures that the slice returned by Followers isn't affected by later changes
+// to the graph.
+func TestFollowersCopy(t *testing.T) {
+	g := NewSetGraph()
+
+	g.Follow(1, 10)
+	g.Follow(2, 10)
+	followers := g.Followers(10)
+	g.Unfollow(1, 10)
+
+	if want := []int{1, 2}; !reflect.DeepEqual(followers, want) {
+		t.Fatalf("Returned followers modified: got %v, want %v", followers, want)
+	}
+}
+
+// TestShardedGraph ensures that relationships spanning shards are stored in both directions, and
+// that graphs constructed with no shards have a single one instead of failing.
+func TestShardedGraph(t *testing.T) {
+	for _, shards := range []int{4, 1, 0, -1} {
+		g := NewShardedGraph(shards)
+
+		g.Follow(1, 2)
+		g.Follow(5, 2)
+		g.Follow(2, 1)
+		g.Unfollow(5, 2)
+
+		if got, want := g.Followers(2), []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d shards: invalid followers: got %v, want %v", shards, got, want)
+		}
+		if got, want := g.Following(2), []int{1}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d shards: invalid following: got %v, want %v", shards, got, want)
+		}
+		if got := g.Following(5); len(got) != 0 {
+			t.Fatalf("%d shards: invalid following: got %v, want none", shards, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package userclients
+
+import "sync"
+
+// groupShard holds the members of the groups whose IDs map to the shard. A group exists as long as
+// it has an entry in members, even if all of its members have left.
+type groupShard struct {
+	lock    sync.RWMutex
+	members map[int]*intSet
+}
+
+// groups stores group membership. It is striped across shards keyed by group ID.
+type groups struct {
+	shards []*groupShard
+}
+
+func newGroups(shards int) *groups {
+	g := &groups{shards: make([]*groupShard, shards)}
+	for i := range g.shards {
+		g.shards[i] = &groupShard{members: make(map[int]*intSet)}
+	}
+
+	return g
+}
+
+// shard returns the shard holding the given group ID.
+func (g *groups) shard(group int) *groupShard {
+	return g.shards[shardIndex(group, len(g.shards))]
+}
+
+// CreateGroup creates a group whose first member is owner. It returns false if the group already
+// exists.
+func (uh *UserHandler) CreateGroup(owner, group int) bool {
+	s := uh.groups.shard(group)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.members[group]; ok {
+		return false
+	}
+	members := newIntSet()
+	members.add(owner)
+	s.members[group] = members
+
+	return true
+}
+
+// JoinGroup adds a user to a group. It returns false if the group doesn't exist. Joining a group
+// more than once has no effect.
+func (uh *UserHandler) JoinGroup(user, group int) bool {
+	s := uh.groups.shard(group)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members, ok := s.members[group]
+	if !ok {
+		return false
+	}
+	members.add(user)
+
+	return true
+}
+
+// LeaveGroup removes a user from a group.
+func (uh *UserHandler) LeaveGroup(user, group int) {
+	s := uh.groups.shard(group)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if members, ok := s.members[group]; ok {
+		members.remove(user)
+	}
+}
+
+// IsMember reports whether a user is a member of a group.
+func (uh *UserHandler) IsMember(user, group int) bool {
+	s := uh.groups.shard(group)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	members, ok := s.members[group]
+	return ok && members.contains(user)
+}
+
+// GroupMembersSnapshot returns a copy of the members of a group, in the order in which they joined.
+func (uh *UserHandler) GroupMembersSnapshot(group int) []int {
+	s := uh.groups.shard(group)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	members, ok := s.members[group]
+	if !ok {
+		return nil
+	}
+
+	return members.slice()
+}
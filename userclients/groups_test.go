@@ -0,0 +1,39 @@
+package userclients
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	uh := NewUserHandler()
+
+	if uh.JoinGroup(2, 500) {
+		t.Fatal("Joined a group which doesn't exist")
+	}
+	if !uh.CreateGroup(1, 500) {
+		t.Fatal("Group not created")
+	}
+	if uh.CreateGroup(2, 500) {
+		t.Fatal("Group created twice")
+	}
+
+	uh.JoinGroup(3, 500)
+	uh.JoinGroup(2, 500)
+	uh.JoinGroup(3, 500)
+	uh.LeaveGroup(1, 500)
+
+	if got, want := uh.GroupMembersSnapshot(500), []int{3, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Invalid members: got %v, want %v", got, want)
+	}
+	if uh.IsMember(1, 500) || !uh.IsMember(2, 500) {
+		t.Fatal("Invalid membership")
+	}
+
+	// A group still exists after all of its members have left.
+	uh.LeaveGroup(2, 500)
+	uh.LeaveGroup(3, 500)
+	if !uh.JoinGroup(4, 500) {
+		t.Fatal("Group deleted after all members left")
+	}
+}
@@ -0,0 +1,66 @@
+package userclients
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake limits
+const (
+	// defaultHandshakeTimeout is the time a TCP user client has for sending its credentials after
+	// connecting.
+	defaultHandshakeTimeout = 10 * time.Second
+	// defaultMaxPendingHandshakes is the number of TCP handshakes which may be in progress at once.
+	// Connections accepted while this many handshakes are pending are closed right away.
+	defaultMaxPendingHandshakes = 1024
+)
+
+// HandshakeStats holds counters of the handshakes of TCP user clients since the user handler was
+// created.
+type HandshakeStats struct {
+	// Completed counts clients which identified successfully, including multiplexed gateways.
+	Completed int64
+	// TimedOut counts clients which didn't identify within the handshake timeout.
+	TimedOut int64
+	// Failed counts clients which sent invalid or unauthenticated credentials, or disconnected
+	// before identifying.
+	Failed int64
+	// Dropped counts connections which were closed because too many handshakes were pending.
+	Dropped int64
+}
+
+// handshakeStats is the internal, concurrently updated counterpart of HandshakeStats.
+type handshakeStats struct {
+	completed int64
+	timedOut  int64
+	failed    int64
+	dropped   int64
+}
+
+// HandshakeStats returns a snapshot of the user handler's handshake counters.
+func (uh *UserHandler) HandshakeStats() HandshakeStats {
+	return HandshakeStats{
+		Completed: atomic.LoadInt64(&uh.stats.completed),
+		TimedOut:  atomic.LoadInt64(&uh.stats.timedOut),
+		Failed:    atomic.LoadInt64(&uh.stats.failed),
+		Dropped:   atomic.LoadInt64(&uh.stats.dropped),
+	}
+}
+
+// SetHandshakeLimits sets the time a TCP user client has for identifying and the number of
+// handshakes which may be pending at once. A zero timeout disables the handshake deadline. It
+// returns an error if the timeout is negative or maxPending isn't positive, since no connection
+// would ever be accepted. It must be called before Run.
+func (uh *UserHandler) SetHandshakeLimits(timeout time.Duration, maxPending int) error {
+	if timeout < 0 {
+		return errors.New("negative handshake timeout")
+	}
+	if maxPending < 1 {
+		return errors.New("at least one handshake has to be allowed to be pending")
+	}
+	uh.handshakeTimeout = timeout
+	uh.pending = make(chan struct{}, maxPending)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package userclients
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHandshakeTimeout ensures that a client which never identifies is disconnected once the
+// handshake timeout expires and is counted as timed out.
+func TestHandshakeTimeout(t *testing.T) {
+	uh := NewUserHandler()
+	if err := uh.SetHandshakeLimits(10*time.Millisecond, 1); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+
+	select {
+	case u, ok := <-uh.handleUser(server):
+		if ok {
+			t.Fatalf("User returned without a handshake: %v", u.id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handshake didn't time out")
+	}
+
+	if got := uh.HandshakeStats(); got != (HandshakeStats{TimedOut: 1}) {
+		t.Fatalf("Invalid handshake stats: got %+v", got)
+	}
+}
+
+// deadlineConn is a connection which records the last read deadline set on it.
+type deadlineConn struct {
+	net.Conn
+	lock     sync.Mutex
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) readDeadline() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.deadline
+}
+
+// TestHandshakeStats ensures that completed and failed handshakes are counted, and that identified
+// clients aren't subject to the handshake timeout.
+func TestHandshakeStats(t *testing.T) {
+	uh := NewUserHandler()
+	if err := uh.SetHandshakeLimits(time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &deadlineConn{Conn: server}
+	ch := uh.handleUser(conn)
+	client.Write([]byte("123\n"))
+	if u := <-ch; u.id != 123 {
+		t.Fatalf("Invalid user ID: got %v, want 123", u.id)
+	}
+	if d := conn.readDeadline(); !d.IsZero() {
+		t.Fatalf("Handshake deadline not cleared after identifying: %v", d)
+	}
+	go client.Write([]byte("?FOLLOWERS\n"))
+	if _, err := client.Read(make([]byte, 64)); err != nil {
+		t.Fatal("Identified client disconnected:", err)
+	}
+
+	bad, server := net.Pipe()
+	defer bad.Close()
+	ch = uh.handleUser(server)
+	bad.Write([]byte("nope\n"))
+	if _, ok := <-ch; ok {
+		t.Fatal("User returned for invalid credentials")
+	}
+
+	if got := uh.HandshakeStats(); got != (HandshakeStats{Completed: 1, Failed: 1}) {
+		t.Fatalf("Invalid handshake stats: got %+v", got)
+	}
+}
+
+// TestSetHandshakeLimitsInvalid ensures that limits under which no connection would be accepted are
+// rejected and leave the previous limits in place.
+func TestSetHandshakeLimitsInvalid(t *testing.T) {
+	uh := NewUserHandler()
+	if err := uh.SetHandshakeLimits(time.Second, 0); err == nil {
+		t.Fatal("Expected an error for zero pending handshakes")
+	}
+	if err := uh.SetHandshakeLimits(-time.Second, 1); err == nil {
+		t.Fatal("Expected an error for a negative timeout")
+	}
+	if cap(uh.pending) != defaultMaxPendingHandshakes || uh.handshakeTimeout != defaultHandshakeTimeout {
+		t.Fatalf("Limits changed by invalid values: %v, %d", uh.handshakeTimeout, cap(uh.pending))
+	}
+}
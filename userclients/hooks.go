@@ -0,0 +1,37 @@
+package userclients
+
+// Hooks are functions called by a UserHandler as users connect, disconnect and are notified. Any of
+// them may be nil. Hooks are called synchronously from the goroutine handling the user or the
+// event, so they should return quickly and must not block.
+type Hooks struct {
+	// OnConnect is called once a user has been registered, over any transport.
+	OnConnect func(id int)
+	// OnDisconnect is called once a user has been unregistered. It isn't called for users whose
+	// connection was replaced by a newer one.
+	OnDisconnect func(id int)
+	// OnDeliver is called after a notification has been written to a user's connection.
+	OnDeliver func(id int, message string)
+}
+
+// SetHooks sets the hooks called by the user handler. It must be called before Run.
+func (uh *UserHandler) SetHooks(h Hooks) {
+	uh.hooks = h
+}
+
+func (uh *UserHandler) connected(id int) {
+	if uh.hooks.OnConnect != nil {
+		uh.hooks.OnConnect(id)
+	}
+}
+
+func (uh *UserHandler) disconnected(id int) {
+	if uh.hooks.OnDisconnect != nil {
+		uh.hooks.OnDisconnect(id)
+	}
+}
+
+func (uh *UserHandler) delivered(id int, message string) {
+	if uh.hooks.OnDeliver != nil {
+		uh.hooks.OnDeliver(id, message)
+	}
+}
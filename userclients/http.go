@@ -0,0 +1,67 @@
+package userclients
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// newHTTPHandler returns the HTTP handler which serves user clients that can't use raw TCP.
+func (uh *UserHandler) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", uh.handleWebSocket)
+	mux.HandleFunc("/users/", uh.handleSSE)
+
+	return mux
+}
+
+// RunHTTP starts serving user clients over HTTP. WebSocket clients connect to /ws and send their
+// user ID in the first text frame. SSE clients stream the notifications of a user from
+// /users/{id}/events.
+func (uh *UserHandler) RunHTTP() chan<- bool {
+	quit := make(chan bool)
+
+	uh.running.Add(1)
+	go func() {
+		defer uh.running.Done()
+
+		// Initialize HTTP listener
+		l, err := uh.listen(httpPort)
+		if err != nil {
+			log.Println("Error listening for HTTP users:", err.Error())
+			uh.errs <- err
+			<-quit
+			return
+		}
+
+		log.Println("Listening for HTTP user clients on " + l.Addr().String())
+
+		srv := &http.Server{Handler: uh.newHTTPHandler()}
+		go func() {
+			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Println("Error serving HTTP users:", err.Error())
+			}
+		}()
+
+		// Evict the notification histories of SSE users who are gone for good.
+		evict := time.NewTicker(sseEvictionInterval)
+		defer evict.Stop()
+	loop:
+		for {
+			select {
+			case now := <-evict.C:
+				uh.users.evictHistories(now)
+			case <-quit:
+				break loop
+			}
+		}
+		log.Println("Stopping HTTP user handler")
+		log.Println("Closing HTTP user listener")
+		srv.Close()
+		// Hijacked WebSocket connections and SSE streams aren't closed by the HTTP server.
+		uh.httpConns.closeAll()
+		uh.httpConns.wait()
+	}()
+
+	return quit
+}
@@ -0,0 +1,137 @@
+package userclients
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/johananl/follower-maze/internal/netutil"
+)
+
+// Multiplexing protocol. A gateway connection starts with muxHandshake instead of credentials and
+// then adds users by sending "+<credentials>" (optionally followed by a subscription filter) and
+// removes them by sending "-<id>". Every request is answered in order, with "?OK|+<id>" or
+// "?OK|-<id>" once done or with "?ERROR|<request>|<reason>" if it failed, where the request is
+// identified without its filter. Notifications are prefixed with the target user ID and a space,
+// e.g. "2932 666|F|60|2932".
+const (
+	muxHandshake = "MUX"
+	muxAdd       = "+"
+	muxRemove    = "-"
+	muxOK        = "OK"
+)
+
+// muxConn is the connection of a single user on a multiplexed gateway connection. Every Write is
+// prefixed with the user's ID and sent with a single Write on the gateway connection, so
+// notifications of different users never interleave mid-line.
+type muxConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func newMuxConn(conn net.Conn, id int) *muxConn {
+	return &muxConn{conn, []byte(strconv.Itoa(id) + " ")}
+}
+
+// Write sends p to the gateway, prefixed with the user's ID.
+func (c *muxConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(append(append([]byte{}, c.prefix...), p...)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close does nothing since the gateway connection is shared by many users. It is closed once the
+// gateway disconnects.
+func (c *muxConn) Close() error {
+	return nil
+}
+
+// muxAck formats the acknowledgement of a request sent to a gateway.
+func muxAck(request string) []byte {
+	return []byte(commandPrefix + muxOK + "|" + request + "\n")
+}
+
+// muxError formats an error response to a request sent to a gateway. Requests which can't be told
+// apart are identified by an empty string.
+func muxError(request, reason string) []byte {
+	if request == "" {
+		return []byte(commandPrefix + errorResponse + "|" + reason + "\n")
+	}
+
+	return []byte(commandPrefix + errorResponse + "|" + request + "|" + reason + "\n")
+}
+
+// serveMux serves a multiplexed gateway connection after its handshake has been read. Users are
+// added and removed as requested by the gateway, and all of them are unregistered once the gateway
+// disconnects. Requests which fail are answered with an error response and don't affect the
+// gateway's other users.
+func (uh *UserHandler) serveMux(conn net.Conn, br *bufio.Reader) {
+	log.Printf("Serving a multiplexed user connection at %v", conn.RemoteAddr())
+
+	users := make(map[int]User)
+	defer func() {
+		for _, u := range users {
+			uh.unregisterUser(u)
+		}
+	}()
+
+	// This loop iterates every time a newline-delimited string is read from the TCP connection.
+	for {
+		message, err := br.ReadString('\n')
+		if err != nil {
+			switch err {
+			case io.EOF:
+				log.Println("Got EOF on multiplexed user connection")
+				return
+			case io.ErrClosedPipe: // Used mainly in tests
+				log.Println("Got ErrClosedPipe on multiplexed user connection")
+				return
+			default:
+				if netutil.IsTimeout(err) {
+					log.Println("Timed out reading multiplexed user request:", err.Error())
+					continue
+				}
+				log.Println("Error reading multiplexed user request - closing connection:", err.Error())
+				return
+			}
+		}
+
+		line := strings.TrimSpace(message)
+		switch {
+		case strings.HasPrefix(line, muxAdd):
+			credentials, filter, err := parseHandshake(strings.TrimPrefix(line, muxAdd))
+			if err != nil {
+				conn.Write(muxError(strings.Fields(line)[0], err.Error()))
+				continue
+			}
+			id, err := uh.authenticator.Authenticate(credentials)
+			if err != nil {
+				conn.Write(muxError(muxAdd+credentials, err.Error()))
+				continue
+			}
+
+			u := User{id, newMuxConn(conn, id), filter}
+			uh.registerUser(u)
+			users[id] = u
+			conn.Write(muxAck(muxAdd + strconv.Itoa(id)))
+		case strings.HasPrefix(line, muxRemove):
+			id, err := strconv.Atoi(strings.TrimPrefix(line, muxRemove))
+			if err != nil {
+				conn.Write(muxError(line, "invalid user ID "+strings.TrimPrefix(line, muxRemove)))
+				continue
+			}
+			if u, ok := users[id]; ok {
+				uh.unregisterUser(u)
+				delete(users, id)
+			}
+			conn.Write(muxAck(muxRemove + strconv.Itoa(id)))
+		default:
+			conn.Write(muxError("", "invalid request "+line))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package userclients
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// expectReply reads a reply from a gateway connection and fails the test unless it is want.
+func expectReply(t *testing.T, br *bufio.Reader, want string) {
+	got, err := br.ReadString('\n')
+	if err != nil || got != want {
+		t.Fatalf("Invalid response: got %q, %v, want %q", got, err, want)
+	}
+}
+
+// TestMux ensures that a gateway connection can register and remove many users and receives their
+// notifications prefixed with the user ID, and that every request is answered.
+func TestMux(t *testing.T) {
+	uh := NewUserHandler()
+	users := watchUsers(uh)
+	client, server := net.Pipe()
+	defer client.Close()
+	br := bufio.NewReader(client)
+
+	ch := uh.handleUser(server)
+	client.Write([]byte("MUX\n"))
+	if u, ok := <-ch; ok {
+		t.Fatalf("User returned for a multiplexed connection: %v", u.id)
+	}
+
+	go client.Write([]byte("+1\n+2 types=P\n"))
+	expectReply(t, br, "?OK|+1\n")
+	expectReply(t, br, "?OK|+2\n")
+	awaitUsers(t, users.connected, 1, 2)
+
+	go func() {
+		uh.NotifyUser(1, "5|B\n")
+		uh.NotifyUser(2, "6|B\n")
+		uh.NotifyUser(2, "7|P|1|2\n")
+	}()
+	for _, want := range []string{"1 5|B\n", "2 7|P|1|2\n"} {
+		got, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("Invalid notification: got %q, want %q", got, want)
+		}
+	}
+
+	go client.Write([]byte("-1\n"))
+	expectReply(t, br, "?OK|-1\n")
+	awaitUsers(t, users.disconnected, 1)
+	if _, ok := uh.users.get(2); !ok {
+		t.Fatal("User removed along with another user")
+	}
+
+	// Failed requests are answered with an error identifying them.
+	go client.Write([]byte("+abc\n+3 bogus=1\n-abc\nbogus\n"))
+	expectReply(t, br, "?ERROR|+abc|strconv.Atoi: parsing \"abc\": invalid syntax\n")
+	expectReply(t, br, "?ERROR|+3|invalid handshake option bogus=1\n")
+	expectReply(t, br, "?ERROR|-abc|invalid user ID abc\n")
+	expectReply(t, br, "?ERROR|invalid request bogus\n")
+
+	// All remaining users are unregistered once the gateway disconnects.
+	client.Close()
+	awaitUsers(t, users.disconnected, 2)
+}
+
+// TestMuxReadError ensures that a gateway connection is closed and its users are unregistered once
+// a read fails with an error which isn't a timeout.
+func TestMuxReadError(t *testing.T) {
+	h := NewUserHandler()
+	users := watchUsers(h)
+	c := &brokenConn{handshake: "MUX\n+1\n+2\n"}
+
+	h.handleUser(c)
+	awaitUsers(t, users.disconnected, 1, 2)
+
+	if reads := atomic.LoadInt32(&c.reads); reads != 2 {
+		t.Fatalf("Invalid number of reads: got %d, want 2", reads)
+	}
+}
@@ -0,0 +1,232 @@
+package userclients
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultShards is the number of shards used by the user registry and the default follow graph.
+// Users are spread across shards by ID, so operations on different users rarely contend for the
+// same lock.
+const defaultShards = 64
+
+// shardIndex returns the index of the shard holding the given user ID.
+func shardIndex(id, shards int) int {
+	return int(uint(id) % uint(shards))
+}
+
+// registryShard holds the connected users whose IDs map to the shard, as well as the notification
+// history of those who have connected over SSE.
+type registryShard struct {
+	lock    sync.RWMutex
+	users   map[int]User
+	history map[int]*notificationHistory
+}
+
+// registry maps user IDs to connected users. It is striped across shards, each guarded by its own lock.
+// Shard locks are never held while writing to a connection. Deliveries to users with a notification
+// history are serialized by the history's own lock instead, so a slow client only holds up itself.
+type registry struct {
+	shards []*registryShard
+}
+
+func newRegistry(shards int) *registry {
+	r := &registry{shards: make([]*registryShard, shards)}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{
+			users:   make(map[int]User),
+			history: make(map[int]*notificationHistory),
+		}
+	}
+
+	return r
+}
+
+// shard returns the shard holding the given user ID.
+func (r *registry) shard(id int) *registryShard {
+	return r.shards[shardIndex(id, len(r.shards))]
+}
+
+// get returns a connected user.
+func (r *registry) get(id int) (User, bool) {
+	s := r.shard(id)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	u, ok := s.users[id]
+	return u, ok
+}
+
+// set registers a connected user, replacing any previous connection of the user.
+func (r *registry) set(u User) {
+	s := r.shard(u.id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[u.id] = u
+}
+
+// remove unregisters a user, but only if the user is still registered on the same connection. It
+// reports whether the user was removed.
+func (r *registry) remove(u User) bool {
+	s := r.shard(u.id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cur, ok := s.users[u.id]; ok && cur.connection == u.connection {
+		delete(s.users, u.id)
+		s.expireHistory(u.id)
+		return true
+	}
+
+	return false
+}
+
+// move atomically re-registers a connection under another user. The previous user is unregistered
+// only if still registered on the same connection. Both shards are locked in index order, so
+// notifications are never delivered to both users nor to neither of them. It reports whether the
+// previous user was unregistered.
+func (r *registry) move(from, to User) bool {
+	i, j := shardIndex(from.id, len(r.shards)), shardIndex(to.id, len(r.shards))
+	if j < i {
+		i, j = j, i
+	}
+	r.shards[i].lock.Lock()
+	defer r.shards[i].lock.Unlock()
+	if i != j {
+		r.shards[j].lock.Lock()
+		defer r.shards[j].lock.Unlock()
+	}
+
+	fromShard, toShard := r.shard(from.id), r.shard(to.id)
+	removed := false
+	if cur, ok := fromShard.users[from.id]; ok && cur.connection == from.connection {
+		delete(fromShard.users, from.id)
+		fromShard.expireHistory(from.id)
+		removed = true
+	}
+	toShard.users[to.id] = to
+
+	return removed
+}
+
+// deliveryResult is the outcome of delivering a message to a user.
+type deliveryResult int
+
+const (
+	// deliveryOK means the message was written to the user's connection.
+	deliveryOK deliveryResult = iota
+	// deliveryFiltered means the user's filter excludes the message.
+	deliveryFiltered
+	// deliveryOffline means the user isn't connected.
+	deliveryOffline
+	// deliveryFailed means writing to the user's connection failed.
+	deliveryFailed
+)
+
+// deliver sends a message to a user if the user is connected and the user's filter allows it. The
+// message is also recorded in the user's notification history, if there is one. In that case
+// recording and sending are done while holding the history's delivery lock so that an SSE client
+// which is resuming neither misses the message nor receives it twice. The shard's lock is never
+// held while writing to the connection.
+func (r *registry) deliver(id int, message string) deliveryResult {
+	s := r.shard(id)
+	s.lock.RLock()
+	u, ok := s.users[id]
+	h, recorded := s.history[id]
+	s.lock.RUnlock()
+	if !recorded {
+		return send(u, ok, message)
+	}
+
+	h.deliverLock.Lock()
+	defer h.deliverLock.Unlock()
+	h.record(message)
+	// The user may have resumed on another connection since it was looked up.
+	u, ok = r.get(id)
+	return send(u, ok, message)
+}
+
+// send writes a message to the connection of a user unless the user isn't connected or the user's
+// filter excludes the message.
+func send(u User, connected bool, message string) deliveryResult {
+	switch {
+	case !connected:
+		return deliveryOffline
+	case !u.filter.allows(message):
+		return deliveryFiltered
+	}
+	if _, err := u.connection.Write([]byte(message)); err != nil {
+		return deliveryFailed
+	}
+
+	return deliveryOK
+}
+
+// expireHistory sets the time at which the notification history of a user who has just been
+// unregistered may be evicted, if the user has a history. It must be called while holding the
+// shard's lock.
+func (s *registryShard) expireHistory(id int) {
+	if h, ok := s.history[id]; ok {
+		h.expires = time.Now().Add(sseHistoryTTL)
+	}
+}
+
+// evictHistories deletes the notification histories of users who have been disconnected for longer
+// than sseHistoryTTL, since these users are considered gone for good.
+func (r *registry) evictHistories(now time.Time) {
+	for _, s := range r.shards {
+		s.lock.Lock()
+		for id, h := range s.history {
+			if _, connected := s.users[id]; !connected && now.After(h.expires) {
+				delete(s.history, id)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// resume registers a user and, if replay is set, first sends the user the notifications recorded
+// in the user's history after the given sequence. A history is created for users who don't have one
+// yet, so that their notifications are recorded from now on.
+func (r *registry) resume(u User, since int, replay bool) {
+	s := r.shard(u.id)
+	s.lock.Lock()
+	h, ok := s.history[u.id]
+	if !ok {
+		h = &notificationHistory{}
+		s.history[u.id] = h
+	}
+	s.lock.Unlock()
+
+	// Replaying and registering are done while holding the history's delivery lock, so deliveries
+	// to the user wait until the user is registered, without holding up the rest of the shard.
+	h.deliverLock.Lock()
+	defer h.deliverLock.Unlock()
+	if replay {
+		for _, n := range h.since(since) {
+			if u.filter.allows(n.message) {
+				u.connection.Write([]byte(n.message))
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// The history is stored again in case it was evicted while replaying.
+	s.history[u.id] = h
+	s.users[u.id] = u
+}
+
+// ids returns a snapshot of the IDs of all connected users. Shards are locked one at a time, so
+// the snapshot isn't atomic across shards: users connecting or disconnecting while the snapshot is
+// taken may or may not be included.
+func (r *registry) ids() []int {
+	var result []int
+	for _, s := range r.shards {
+		s.lock.RLock()
+		for id := range s.users {
+			result = append(result, id)
+		}
+		s.lock.RUnlock()
+	}
+
+	return result
+}
@@ -0,0 +1,49 @@
+package userclients
+
+import (
+	"net"
+	"sort"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry(4)
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+
+	for _, id := range []int{1, 2, 5, -3} {
+		r.set(User{id: id, connection: first})
+	}
+
+	ids := r.ids()
+	sort.Ints(ids)
+	if len(ids) != 4 || ids[0] != -3 || ids[3] != 5 {
+		t.Fatalf("Invalid snapshot: got %v", ids)
+	}
+
+	// Removing a user who has reconnected on a different connection has no effect.
+	r.set(User{id: 5, connection: second})
+	r.remove(User{id: 5, connection: first})
+	if u, ok := r.get(5); !ok || u.connection != second {
+		t.Fatal("Reconnected user removed")
+	}
+
+	r.remove(User{id: 5, connection: second})
+	if _, ok := r.get(5); ok {
+		t.Fatal("User not removed")
+	}
+}
+
+func TestRegistryMove(t *testing.T) {
+	r := newRegistry(4)
+	conn, _ := net.Pipe()
+
+	r.set(User{id: 1, connection: conn})
+	r.move(User{id: 1, connection: conn}, User{id: 6, connection: conn})
+	if _, ok := r.get(1); ok {
+		t.Fatal("Previous user not removed")
+	}
+	if u, ok := r.get(6); !ok || u.connection != conn {
+		t.Fatal("New user not registered")
+	}
+}
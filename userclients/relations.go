@@ -0,0 +1,88 @@
+package userclients
+
+import "sync"
+
+// relationShard holds the relationships of the users whose IDs map to the shard.
+type relationShard struct {
+	lock sync.RWMutex
+	adj  adjacency
+}
+
+// relation stores a one-directional relationship between users, such as "blocks" or "mutes". It
+// is striped across shards keyed by the ID of the user the relationship originates from.
+type relation struct {
+	shards []*relationShard
+}
+
+func newRelation(shards int) *relation {
+	r := &relation{shards: make([]*relationShard, shards)}
+	for i := range r.shards {
+		r.shards[i] = &relationShard{adj: make(adjacency)}
+	}
+
+	return r
+}
+
+// shard returns the shard holding the relationships originating from the given user ID.
+func (r *relation) shard(id int) *relationShard {
+	return r.shards[shardIndex(id, len(r.shards))]
+}
+
+// add records that from relates to to.
+func (r *relation) add(from, to int) {
+	s := r.shard(from)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.adj.add(from, to)
+}
+
+// remove deletes the relationship between from and to.
+func (r *relation) remove(from, to int) {
+	s := r.shard(from)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.adj.remove(from, to)
+}
+
+// has reports whether from relates to to.
+func (r *relation) has(from, to int) bool {
+	s := r.shard(from)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	set, ok := s.adj[from]
+	return ok && set.contains(to)
+}
+
+// Block records that from blocks to and removes any follow relationship between the two users, in
+// both directions.
+func (uh *UserHandler) Block(from, to int) {
+	uh.blocks.add(from, to)
+	uh.graph.Unfollow(from, to)
+	uh.graph.Unfollow(to, from)
+}
+
+// Unblock removes a block. Follow relationships removed by the block aren't restored.
+func (uh *UserHandler) Unblock(from, to int) {
+	uh.blocks.remove(from, to)
+}
+
+// Blocked reports whether either of the given users blocks the other.
+func (uh *UserHandler) Blocked(a, b int) bool {
+	return uh.blocks.has(a, b) || uh.blocks.has(b, a)
+}
+
+// Mute records that from no longer wants to receive status updates from to. Unlike a block, a mute
+// doesn't affect follow relationships.
+func (uh *UserHandler) Mute(from, to int) {
+	uh.mutes.add(from, to)
+}
+
+// Unmute removes a mute.
+func (uh *UserHandler) Unmute(from, to int) {
+	uh.mutes.remove(from, to)
+}
+
+// Muted reports whether from has muted to.
+func (uh *UserHandler) Muted(from, to int) bool {
+	return uh.mutes.has(from, to)
+}
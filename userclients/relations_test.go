@@ -0,0 +1,51 @@
+package userclients
+
+import "testing"
+
+// TestBlock ensures that a block removes follows in both directions and applies to both users.
+func TestBlock(t *testing.T) {
+	uh := NewUserHandler()
+	uh.Follow(1, 2)
+	uh.Follow(2, 1)
+	uh.Follow(3, 2)
+
+	uh.Block(1, 2)
+
+	if !uh.Blocked(1, 2) || !uh.Blocked(2, 1) {
+		t.Fatal("Block not registered in both directions")
+	}
+	if uh.Blocked(1, 3) {
+		t.Fatal("Unrelated users reported as blocked")
+	}
+	if f := uh.FollowersSnapshot(2); len(f) != 1 || f[0] != 3 {
+		t.Fatalf("Invalid followers after block: got %v, want [3]", f)
+	}
+	if f := uh.FollowersSnapshot(1); len(f) != 0 {
+		t.Fatalf("Invalid followers after block: got %v, want none", f)
+	}
+
+	uh.Unblock(1, 2)
+	if uh.Blocked(1, 2) {
+		t.Fatal("Block not removed")
+	}
+}
+
+// TestMute ensures that a mute is one-directional and doesn't affect follows.
+func TestMute(t *testing.T) {
+	uh := NewUserHandler()
+	uh.Follow(1, 2)
+
+	uh.Mute(1, 2)
+
+	if !uh.Muted(1, 2) || uh.Muted(2, 1) {
+		t.Fatal("Invalid mute state")
+	}
+	if f := uh.FollowersSnapshot(2); len(f) != 1 || f[0] != 1 {
+		t.Fatalf("Mute affected followers: got %v, want [1]", f)
+	}
+
+	uh.Unmute(1, 2)
+	if uh.Muted(1, 2) {
+		t.Fatal("Mute not removed")
+	}
+}
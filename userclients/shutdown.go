@@ -0,0 +1,89 @@
+package userclients
+
+import (
+	"net"
+	"sync"
+)
+
+// connections tracks the open connections of user clients so that they can be closed when the user
+// handler stops. Tracked connections are wrapped, and a connection is only considered closed once
+// its handler has closed the wrapper, which is done after the user has been unregistered.
+type connections struct {
+	lock    sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func newConnections() *connections {
+	return &connections{conns: make(map[net.Conn]struct{})}
+}
+
+// trackedConn is a tracked connection. Closing it stops tracking the connection.
+type trackedConn struct {
+	net.Conn
+	owner *connections
+	once  sync.Once
+}
+
+// Close closes the connection and stops tracking it.
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.owner.lock.Lock()
+		delete(c.owner.conns, c.Conn)
+		c.owner.lock.Unlock()
+		c.owner.wg.Done()
+	})
+
+	return err
+}
+
+// track starts tracking a connection and returns the wrapper which should be used in its place. It
+// returns false if the connections are being closed, in which case the caller should close the
+// connection right away.
+func (c *connections) track(conn net.Conn) (net.Conn, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closing {
+		return nil, false
+	}
+	c.conns[conn] = struct{}{}
+	c.wg.Add(1)
+
+	return &trackedConn{Conn: conn, owner: c}, true
+}
+
+// closeAll closes all tracked connections and stops accepting new ones. Their handlers notice and
+// finish up, which wait waits for.
+func (c *connections) closeAll() {
+	c.lock.Lock()
+	c.closing = true
+	conns := make([]net.Conn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// wait blocks until the handlers of all tracked connections have closed them.
+func (c *connections) wait() {
+	c.wg.Wait()
+}
+
+// Wait blocks until the user handler has stopped, once the channels returned by Run and RunHTTP
+// (if called) have been signaled. By then all connections of user clients have been closed and
+// their users unregistered.
+func (uh *UserHandler) Wait() {
+	uh.running.Wait()
+}
+
+// Errors returns a channel which receives the errors that keep Run or RunHTTP from serving, such as
+// listen errors. The handler must still be stopped through the channel returned by the failed call.
+func (uh *UserHandler) Errors() <-chan error {
+	return uh.errs
+}
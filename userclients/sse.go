@@ -0,0 +1,271 @@
+package userclients
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSE history limits
+const (
+	// sseHistorySize is the number of recent notifications kept for every user who has connected
+	// over Server-Sent Events. Reconnecting clients are sent the notifications they missed, as long
+	// as these are still in the history.
+	sseHistorySize = 1000
+	// sseHistoryTTL is the time the history of a disconnected user is kept for. Users who don't
+	// reconnect in time are considered gone for good and their history is evicted.
+	sseHistoryTTL = 10 * time.Minute
+	// sseEvictionInterval is the interval at which expired histories are evicted.
+	sseEvictionInterval = time.Minute
+)
+
+var errSSEClosed = errors.New("SSE stream closed")
+
+// notification is a notification sent to a user, along with the sequence of the event it carries.
+type notification struct {
+	sequence int
+	message  string
+}
+
+// notificationHistory is a fixed-size ring buffer holding the most recent notifications of a user.
+// expires is the time after which the history may be evicted if the user is still disconnected. It
+// is guarded by the lock of the registry shard holding the history. deliverLock serializes
+// deliveries to the user with the user resuming.
+type notificationHistory struct {
+	lock    sync.Mutex
+	entries []notification
+	next    int
+	full    bool
+	expires time.Time
+
+	deliverLock sync.Mutex
+}
+
+// add stores a notification in the history, overwriting the oldest one if the history is full.
+func (h *notificationHistory) add(n notification) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.entries == nil {
+		h.entries = make([]notification, sseHistorySize)
+	}
+	h.entries[h.next] = n
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// since returns the notifications in the history with a sequence greater than seq, oldest first.
+func (h *notificationHistory) since(seq int) []notification {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var ordered []notification
+	if h.full {
+		ordered = append(ordered, h.entries[h.next:]...)
+	}
+	ordered = append(ordered, h.entries[:h.next]...)
+
+	var result []notification
+	for _, n := range ordered {
+		if n.sequence > seq {
+			result = append(result, n)
+		}
+	}
+
+	return result
+}
+
+// record stores a message in the history. Messages without a valid sequence aren't recorded since
+// clients can't resume from them.
+func (h *notificationHistory) record(message string) {
+	seq, err := sequenceOf(message)
+	if err != nil {
+		log.Printf("Not recording notification %q: %s", message, err.Error())
+		return
+	}
+	h.add(notification{seq, message})
+}
+
+// sequenceOf extracts the sequence number from a raw event.
+func sequenceOf(message string) (int, error) {
+	i := strings.IndexByte(message, '|')
+	if i < 0 {
+		i = len(strings.TrimRight(message, "\r\n"))
+	}
+
+	return strconv.Atoi(message[:i])
+}
+
+// sseAddr is the net.Addr of an SSE client, which is only known by its remote address string.
+type sseAddr string
+
+func (a sseAddr) Network() string { return "tcp" }
+func (a sseAddr) String() string  { return string(a) }
+
+// sseConn implements net.Conn on top of an HTTP response streamed as Server-Sent Events. Every Write
+// sends a single SSE message whose ID is the sequence of the event being sent. This allows SSE
+// clients to be stored in the Users registry alongside TCP clients and be notified by NotifyUser
+// without any special handling.
+type sseConn struct {
+	w      http.ResponseWriter
+	f      http.Flusher
+	remote sseAddr
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// Read blocks until the stream is closed since SSE clients never send data after connecting.
+func (c *sseConn) Read(p []byte) (int, error) {
+	<-c.done
+	return 0, io.EOF
+}
+
+// Write sends p to the client as a single SSE message.
+func (c *sseConn) Write(p []byte) (int, error) {
+	message := string(p)
+	seq, err := sequenceOf(message)
+	if err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, errSSEClosed
+	}
+
+	fmt.Fprintf(c.w, "id: %d\ndata: %s\n\n", seq, strings.TrimRight(message, "\r\n"))
+	c.f.Flush()
+
+	return len(p), nil
+}
+
+// Close marks the stream as closed. The HTTP response itself is finished once the handler returns.
+func (c *sseConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+
+	return nil
+}
+
+func (c *sseConn) LocalAddr() net.Addr                { return sseAddr("") }
+func (c *sseConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *sseConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sseConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sseConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// parseSSEPath extracts the user ID from a path of the form /users/{id}/events.
+func parseSSEPath(path string) (int, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "users" || parts[2] != "events" {
+		return 0, false
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// handleSSE streams the notifications of a user as Server-Sent Events. The client authenticates with
+// a bearer token or a token query parameter, and the user is registered in the Users registry for
+// as long as the client stays connected. A types query parameter, e.g. types=F,P, restricts the
+// event types the client receives. Clients which reconnect with a Last-Event-ID header are first
+// sent the notifications they missed since that sequence.
+func (uh *UserHandler) handleSSE(w http.ResponseWriter, r *http.Request) {
+	userID, ok := parseSSEPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Browsers can't set headers on EventSource requests so the token may also be passed as a
+	// query parameter.
+	credentials := strconv.Itoa(userID)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token != "" {
+		credentials += ":" + token
+	}
+	if id, err := uh.authenticator.Authenticate(credentials); err != nil || id != userID {
+		log.Printf("Rejecting SSE user connection at %v: authentication failed", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var filter typeFilter
+	if types := r.URL.Query().Get(typesOption); types != "" {
+		var err error
+		if filter, err = parseTypeFilter(types); err != nil {
+			http.Error(w, "Invalid types: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Only clients which are reconnecting send a Last-Event-ID, so new clients aren't sent old
+	// notifications.
+	lastEventID, replay := 0, false
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		lastEventID, replay = id, true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	sc := &sseConn{w: w, f: f, remote: sseAddr(r.RemoteAddr), done: make(chan struct{})}
+	conn, ok := uh.httpConns.track(sc)
+	if !ok {
+		log.Printf("User handler stopping - closing SSE user connection at %v", sc.RemoteAddr())
+		return
+	}
+	log.Printf("Accepted an SSE user connection from %v", conn.RemoteAddr())
+
+	// Replay missed notifications and register the user atomically with respect to NotifyUser so
+	// that no notification is lost or sent twice.
+	u := User{userID, conn, filter}
+	uh.users.resume(u, lastEventID, replay)
+	uh.connected(u.id)
+
+	defer func() {
+		log.Printf("Closing SSE user connection at %v\n", conn.RemoteAddr())
+		uh.unregisterUser(u)
+		conn.Close()
+	}()
+
+	select {
+	case <-r.Context().Done():
+	case <-sc.done:
+	}
+}
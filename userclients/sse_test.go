@@ -0,0 +1,185 @@
+package userclients
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSEMessage reads a single SSE message and returns its id and data fields.
+func readSSEMessage(t *testing.T, br *bufio.Reader) (string, string) {
+	var id, data string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			return id, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// TestSSEResume ensures that SSE clients receive notifications and that a client reconnecting with
+// a Last-Event-ID header is sent the notifications it missed.
+func TestSSEResume(t *testing.T) {
+	uh := NewUserHandler()
+	users := watchUsers(uh)
+	srv := httptest.NewServer(uh.newHTTPHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/users/77/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitUsers(t, users.connected, 77)
+
+	uh.NotifyUser(77, "1|B\n")
+	id, data := readSSEMessage(t, bufio.NewReader(resp.Body))
+	if id != "1" || data != "1|B" {
+		t.Fatalf("Invalid SSE message: got id %q data %q, want id %q data %q", id, data, "1", "1|B")
+	}
+	resp.Body.Close()
+
+	// Wait for the user to be unregistered, then send notifications while disconnected.
+	awaitUsers(t, users.disconnected, 77)
+	uh.NotifyUser(77, "2|P|5|77\n")
+	uh.NotifyUser(77, "3|B\n")
+
+	req, _ := http.NewRequest("GET", srv.URL+"/users/77/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	for _, want := range []string{"2|P|5|77", "3|B"} {
+		if _, data := readSSEMessage(t, br); data != want {
+			t.Fatalf("Invalid replayed message: got %q, want %q", data, want)
+		}
+	}
+}
+
+// bufferConn is a connection which stores everything written to it.
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+func (c *bufferConn) String() string              { return c.buf.String() }
+
+// TestResumeReplay ensures that missed notifications are only replayed to clients which ask for
+// them, so that new clients aren't sent old notifications.
+func TestResumeReplay(t *testing.T) {
+	r := newRegistry(1)
+	first := User{1, &bufferConn{}, nil}
+	r.resume(first, 0, false)
+	r.deliver(1, "1|B\n")
+	r.remove(first)
+	r.deliver(1, "2|P|2|1\n")
+
+	fresh := &bufferConn{}
+	r.resume(User{1, fresh, nil}, 0, false)
+	if got := fresh.String(); got != "" {
+		t.Fatalf("Notifications replayed to a new client: %q", got)
+	}
+
+	resumed := &bufferConn{}
+	r.resume(User{1, resumed, nil}, 1, true)
+	if got, want := resumed.String(), "2|P|2|1\n"; got != want {
+		t.Fatalf("Invalid replayed notifications: got %q, want %q", got, want)
+	}
+}
+
+// TestEvictHistories ensures that the notification history of a user is evicted once the user has
+// been disconnected for longer than the history's TTL, and not before.
+func TestEvictHistories(t *testing.T) {
+	r := newRegistry(1)
+	gone := User{1, &bufferConn{}, nil}
+	r.resume(gone, 0, false)
+	r.remove(gone)
+	r.resume(User{2, &bufferConn{}, nil}, 0, false)
+
+	r.evictHistories(time.Now())
+	if len(r.shards[0].history) != 2 {
+		t.Fatalf("History evicted before its TTL: %v", r.shards[0].history)
+	}
+
+	r.evictHistories(time.Now().Add(sseHistoryTTL + time.Second))
+	if _, ok := r.shards[0].history[1]; ok {
+		t.Fatal("History of a disconnected user not evicted")
+	}
+	if _, ok := r.shards[0].history[2]; !ok {
+		t.Fatal("History of a connected user evicted")
+	}
+}
+
+func TestParseSSEPath(t *testing.T) {
+	if id, ok := parseSSEPath("/users/2932/events"); !ok || id != 2932 {
+		t.Fatalf("Invalid parse result: got %d, %v", id, ok)
+	}
+	for _, p := range []string{"/users/abc/events", "/users/1", "/users/1/events/x", "/foo/1/events"} {
+		if _, ok := parseSSEPath(p); ok {
+			t.Fatalf("Expected %v not to parse", p)
+		}
+	}
+}
+
+// blockingConn is a connection whose writes block until it is released. Every write is signaled over
+// writing first.
+type blockingConn struct {
+	net.Conn
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingConn) Write(p []byte) (int, error) {
+	c.writing <- struct{}{}
+	<-c.release
+	return len(p), nil
+}
+
+// TestDeliverSlowClient ensures that a slow client with a notification history doesn't hold up
+// registrations and deliveries of other users in the same shard.
+func TestDeliverSlowClient(t *testing.T) {
+	r := newRegistry(1)
+	slow := &blockingConn{writing: make(chan struct{}), release: make(chan struct{})}
+	r.resume(User{1, slow, nil}, 0, false)
+
+	delivered := make(chan deliveryResult)
+	go func() { delivered <- r.deliver(1, "1|B\n") }()
+	<-slow.writing
+
+	done := make(chan struct{})
+	go func() {
+		fast := &bufferConn{}
+		r.set(User{2, fast, nil})
+		r.deliver(2, "1|B\n")
+		r.resume(User{3, &bufferConn{}, nil}, 0, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shard held up by a slow client")
+	}
+
+	close(slow.release)
+	if result := <-delivered; result != deliveryOK {
+		t.Fatalf("Invalid delivery result: got %v, want %v", result, deliveryOK)
+	}
+}
@@ -2,38 +2,64 @@ package userclients
 
 import (
 	"bufio"
+	"crypto/tls"
 	"io"
 	"log"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/johananl/follower-maze/internal/netutil"
 )
 
 const (
-	host = "localhost"
-	port = "9099"
+	host     = "localhost"
+	port     = "9099"
+	httpPort = "9098"
 )
 
 // User represents a user client that is connected to the server. id is the user's ID and
-// connection is the connection on which that user is reachable.
+// connection is the connection on which that user is reachable. filter holds the event types the
+// client subscribed to, or nil if it receives all of them.
 type User struct {
 	id         int
 	connection net.Conn
+	filter     typeFilter
 }
 
 // UserHandler handles users. It is responsible for registering users when they connect to the
-// server, sending events to users and updating their followers status.
-// Both the Users and the followers fields store data in a map for efficient lookups. Both maps
-// have a mutex lock since multiple goroutines access them concurrently for both read and write
-// operations.
+// server, sending events to users and updating their followers status. Connected users are stored
+// in a registry and follow relationships in a graph, while blocks and mutes are stored as relations
+// and group membership in groups. All of them are striped across shards keyed by user ID since
+// multiple goroutines access them concurrently for both read and write operations. If tlsConfig is
+// set, user clients have to connect over TLS. Listeners are created by listenFunc. Every client is
+// authenticated by authenticator before being registered. Notifications of users who aren't
+// connected are passed to sink, if set. TCP clients have handshakeTimeout for identifying, and at
+// most cap(pending) of them may be identifying at once. Open connections are tracked in tcpConns
+// and httpConns so that they can be closed on shutdown.
 type UserHandler struct {
-	// TODO Use channels instead of mutexes?
-	Users     map[int]net.Conn
-	uLock     sync.RWMutex
-	followers map[int][]int
-	fLock     sync.RWMutex
+	users         *registry
+	graph         Graph
+	blocks        *relation
+	mutes         *relation
+	groups        *groups
+	tlsConfig     *tls.Config
+	listenFunc    func(network, address string) (net.Listener, error)
+	authenticator Authenticator
+
+	handshakeTimeout time.Duration
+	pending          chan struct{}
+	stats            handshakeStats
+	hooks            Hooks
+	sink             Sink
+
+	tcpConns  *connections
+	httpConns *connections
+	running   sync.WaitGroup
+	errs      chan error
 }
 
 // acceptConnections accepts TCP connections from user clients and sends back net.Conn structs.
@@ -41,7 +67,9 @@ func (uh *UserHandler) acceptConnections(l net.Listener) (<-chan net.Conn, chan<
 	ch := make(chan net.Conn)
 	quit := make(chan bool)
 
+	uh.running.Add(1)
 	go func() {
+		defer uh.running.Done()
 		defer close(ch)
 		// Continually accept user connections. This loop iterates every time a new connection from
 		// a user client is received and blocks at Accept().
@@ -56,27 +84,87 @@ func (uh *UserHandler) acceptConnections(l net.Listener) (<-chan net.Conn, chan<
 					return
 				default:
 				}
+				continue
 			}
 			log.Printf("Accepted a user connection from %v", conn.RemoteAddr())
 
-			ch <- conn
+			select {
+			case ch <- conn:
+			case <-quit:
+				conn.Close()
+				return
+			}
 		}
 	}()
 
 	return ch, quit
 }
 
-// handleUser reads a user ID from the TCP connection and returns a User.
+// handleUser reads the user's credentials from the TCP connection, authenticates them, registers
+// the user and returns the User. The credentials may be followed by a subscription filter, e.g.
+// "2932 types=F,P". The connection is closed if authentication fails. Once identified, the user may
+// send commands, which are answered on the same connection, or switch to another user with the
+// re-identify command. Any other line is a protocol error which closes the connection. The user is
+// unregistered once the connection is closed. Gateway connections which start with the
+// multiplexing handshake register their users themselves, so no User is returned for them. The
+// connection is closed if the client doesn't identify within the handshake timeout.
 func (uh *UserHandler) handleUser(conn net.Conn) <-chan User {
-	ch := make(chan User)
+	ch := make(chan User, 1)
 	go func() {
+		closed := false
+		closeCh := func() {
+			if !closed {
+				close(ch)
+				closed = true
+			}
+		}
+		defer closeCh()
 		// Close connection when done reading.
 		defer func() {
 			log.Printf("Closing user connection at %v\n", conn.RemoteAddr())
 			conn.Close()
 		}()
 
+		if uh.handshakeTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(uh.handshakeTimeout))
+		}
+
 		br := bufio.NewReader(conn)
+		message, err := br.ReadString('\n')
+		if err != nil {
+			if netutil.IsTimeout(err) {
+				atomic.AddInt64(&uh.stats.timedOut, 1)
+				log.Printf("Handshake timed out on user connection at %v", conn.RemoteAddr())
+			} else {
+				atomic.AddInt64(&uh.stats.failed, 1)
+				log.Println("Error reading user handshake:", err.Error())
+			}
+			return
+		}
+
+		if strings.TrimSpace(message) == muxHandshake {
+			atomic.AddInt64(&uh.stats.completed, 1)
+			conn.SetReadDeadline(time.Time{})
+			closeCh()
+			uh.serveMux(conn, br)
+			return
+		}
+
+		u, err := uh.identify(conn, message)
+		if err != nil {
+			atomic.AddInt64(&uh.stats.failed, 1)
+			log.Printf("Rejecting user connection at %v: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		atomic.AddInt64(&uh.stats.completed, 1)
+		conn.SetReadDeadline(time.Time{})
+
+		uh.registerUser(u)
+		defer func() {
+			uh.unregisterUser(u)
+		}()
+		ch <- u
+
 		// This loop iterates every time a newline-delimited string is read from
 		// the TCP connection.
 		for {
@@ -90,94 +178,225 @@ func (uh *UserHandler) handleUser(conn net.Conn) <-chan User {
 					log.Println("Got ErrClosedPipe on user connection")
 					return
 				default:
-					log.Println("Error reading user request:", err.Error())
-					continue // Skip this message and move to the next one.
+					if netutil.IsTimeout(err) {
+						log.Println("Timed out reading user request:", err.Error())
+						continue
+					}
+					log.Println("Error reading user request - closing connection:", err.Error())
+					return
 				}
 			}
 
-			// Parse user ID
-			userID, err := strconv.Atoi(strings.TrimSpace(message))
-			if err != nil {
-				log.Printf("Invalid user ID %d: %s", userID, err.Error())
-				continue
+			switch {
+			case isIdentifyCommand(message):
+				next, err := uh.identify(conn, identifyCredentials(message))
+				if err != nil {
+					log.Printf("Rejecting re-identification at %v: %s", conn.RemoteAddr(), err.Error())
+					conn.Write([]byte(commandPrefix + errorResponse + "|" + err.Error() + "\n"))
+					continue
+				}
+				uh.moveUser(u, next)
+				u = next
+				conn.Write([]byte(commandPrefix + identifyCommand + "|" + strconv.Itoa(u.id) + "\n"))
+			case isCommand(message):
+				conn.Write([]byte(uh.handleCommand(u.id, message)))
+			default:
+				log.Printf("Protocol error on user connection at %v: unexpected line %q", conn.RemoteAddr(), message)
+				conn.Write([]byte(commandPrefix + errorResponse + "|unexpected line - use " +
+					commandPrefix + identifyCommand + " to switch users\n"))
+				return
 			}
-
-			ch <- User{userID, conn}
 		}
 	}()
 
 	return ch
 }
 
+// identify parses a handshake line and authenticates its credentials. It returns the User the
+// connection should be registered as.
+func (uh *UserHandler) identify(conn net.Conn, line string) (User, error) {
+	credentials, filter, err := parseHandshake(line)
+	if err != nil {
+		return User{}, err
+	}
+	id, err := uh.authenticator.Authenticate(credentials)
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{id, conn, filter}, nil
+}
+
 // registerUser maps a user ID to a connection.
 func (uh *UserHandler) registerUser(u User) {
-	uh.uLock.Lock()
-	defer uh.uLock.Unlock()
-	uh.Users[u.id] = u.connection
+	uh.users.set(u)
+	uh.connected(u.id)
 }
 
-// NotifyUser sends a string-encoded event to a user.
+// unregisterUser removes a user's connection mapping. The mapping is left untouched if the user
+// has since reconnected on a different connection.
+func (uh *UserHandler) unregisterUser(u User) {
+	if uh.users.remove(u) {
+		uh.disconnected(u.id)
+	}
+}
+
+// moveUser atomically re-registers a user's connection under another user.
+func (uh *UserHandler) moveUser(from, to User) {
+	if uh.users.move(from, to) {
+		uh.disconnected(from.id)
+	}
+	uh.connected(to.id)
+}
+
+// NotifyUser sends a string-encoded event to a user, unless the user's subscription filter
+// excludes the event's type. If the user isn't connected, the event is passed to the undelivered
+// sink, if one was set.
 func (uh *UserHandler) NotifyUser(id int, message string) {
-	uh.uLock.RLock()
-	defer uh.uLock.RUnlock()
-	if c, ok := uh.Users[id]; ok {
-		c.Write([]byte(message))
+	switch uh.users.deliver(id, message) {
+	case deliveryOK:
+		uh.delivered(id, message)
+	case deliveryOffline:
+		if uh.sink != nil {
+			uh.sink.Undelivered(id, message)
+		}
+	}
+}
+
+// Notify sends a string-encoded event to a user. It is equivalent to NotifyUser.
+func (uh *UserHandler) Notify(id int, message string) {
+	uh.NotifyUser(id, message)
+}
+
+// ConnectedUsers returns a snapshot of the IDs of all connected users. No lock is held once the
+// snapshot is taken, so it is safe to notify the returned users while others connect.
+func (uh *UserHandler) ConnectedUsers() []int {
+	return uh.users.ids()
+}
+
+// ForEachConnected calls fn for every connected user. It iterates over a snapshot of the connected
+// users, so fn is called without holding any lock and may safely notify users, while users keep
+// connecting and disconnecting concurrently.
+func (uh *UserHandler) ForEachConnected(fn func(id int)) {
+	for _, id := range uh.users.ids() {
+		fn(id)
 	}
 }
 
 // Follow registers a user as a follower of another user.
 func (uh *UserHandler) Follow(from, to int) {
-	uh.fLock.Lock()
-	defer uh.fLock.Unlock()
-	uh.followers[to] = append(uh.followers[to], from)
+	uh.graph.Follow(from, to)
 }
 
 // Unfollow removes a user from another user's followers list.
 func (uh *UserHandler) Unfollow(from, to int) {
-	uh.fLock.Lock()
-	defer uh.fLock.Unlock()
-	// If performance for array lookups becomes a problem due to a very large number of
-	// followers, we can change to a sorted array + binary search.
-	for i := 0; i < len(uh.followers[to]); i++ {
-		if uh.followers[to][i] == from {
-			uh.followers[to] = append(uh.followers[to][:i], uh.followers[to][i+1:]...)
-		}
-	}
+	uh.graph.Unfollow(from, to)
 }
 
-// Followers returns a slice of followers for the given user ID.
+// FollowersSnapshot returns a copy of the followers of the given user ID. The copy isn't affected
+// by later Follow and Unfollow operations, so it is safe to iterate over it while these happen.
+func (uh *UserHandler) FollowersSnapshot(id int) []int {
+	return uh.graph.Followers(id)
+}
+
+// Followers returns a slice of followers for the given user ID. It is equivalent to
+// FollowersSnapshot.
 func (uh *UserHandler) Followers(id int) []int {
-	uh.fLock.RLock()
-	defer uh.fLock.RUnlock()
-	return uh.followers[id]
+	return uh.FollowersSnapshot(id)
+}
+
+// Following returns a slice of the users followed by the given user ID.
+func (uh *UserHandler) Following(id int) []int {
+	return uh.graph.Following(id)
 }
 
 // NewUserHandler constructs a new UserHandler and returns a pointer to it.
 func NewUserHandler() *UserHandler {
 	return &UserHandler{
-		Users:     make(map[int]net.Conn),
-		followers: make(map[int][]int),
+		users:         newRegistry(defaultShards),
+		graph:         NewShardedGraph(defaultShards),
+		blocks:        newRelation(defaultShards),
+		mutes:         newRelation(defaultShards),
+		groups:        newGroups(defaultShards),
+		authenticator: IDAuthenticator{},
+		listenFunc:    net.Listen,
+
+		handshakeTimeout: defaultHandshakeTimeout,
+		pending:          make(chan struct{}, defaultMaxPendingHandshakes),
+
+		tcpConns:  newConnections(),
+		httpConns: newConnections(),
+		errs:      make(chan error, 2),
+	}
+}
+
+// SetTLSConfig makes the user handler's listeners accept TLS connections only. It must be called
+// before Run.
+func (uh *UserHandler) SetTLSConfig(config *tls.Config) {
+	uh.tlsConfig = config
+}
+
+// SetGraph replaces the graph used for storing follow relationships. It must be called before any
+// event is processed.
+func (uh *UserHandler) SetGraph(g Graph) {
+	uh.graph = g
+}
+
+// SetAuthenticator replaces the authenticator used during the handshake of user clients. It must be
+// called before Run.
+func (uh *UserHandler) SetAuthenticator(a Authenticator) {
+	uh.authenticator = a
+}
+
+// SetUndeliveredSink sets the sink which receives notifications of users who aren't connected. By
+// default such notifications are dropped. It must be called before any event is processed.
+func (uh *UserHandler) SetUndeliveredSink(s Sink) {
+	uh.sink = s
+}
+
+// SetListenFunc replaces the function used for creating the user handler's listeners, which is
+// net.Listen by default. Tests may inject an in-memory implementation. It must be called before
+// Run.
+func (uh *UserHandler) SetListenFunc(f func(network, address string) (net.Listener, error)) {
+	uh.listenFunc = f
+}
+
+// listen creates a listener on the given port using the listen function, wrapped with TLS if a TLS
+// config was set.
+func (uh *UserHandler) listen(p string) (net.Listener, error) {
+	l, err := uh.listenFunc("tcp", host+":"+p)
+	if err != nil {
+		return nil, err
+	}
+	if uh.tlsConfig != nil {
+		l = tls.NewListener(l, uh.tlsConfig)
 	}
+
+	return l, nil
 }
 
-// Run starts the user handler.
+// Run starts the user handler. Once stopped, all TCP user connections are closed.
 func (uh *UserHandler) Run() chan<- bool {
 	quit := make(chan bool)
 
+	uh.running.Add(1)
 	go func() {
+		defer uh.running.Done()
+
 		// Initialize user clients listener
-		l, err := net.Listen("tcp", host+":"+port)
+		l, err := uh.listen(port)
 		if err != nil {
 			log.Println("Error listening for users:", err.Error())
-			// TODO Replace os.Exit()
-			os.Exit(1)
+			uh.errs <- err
+			<-quit
+			return
 		}
 		defer func() {
 			log.Println("Closing user listener")
 			l.Close()
 		}()
 
-		log.Println("Listening for user clients on " + host + ":" + port)
+		log.Println("Listening for user clients on " + l.Addr().String())
 
 		connections, stopAccept := uh.acceptConnections(l)
 		defer close(stopAccept)
@@ -185,11 +404,32 @@ func (uh *UserHandler) Run() chan<- bool {
 		for {
 			select {
 			case c := <-connections:
-				uch := uh.handleUser(c)
-				u := <-uch
-				uh.registerUser(u)
+				// Handshakes are done off the accept loop so that a slow client can't hold up
+				// registration of other users.
+				select {
+				case uh.pending <- struct{}{}:
+				default:
+					atomic.AddInt64(&uh.stats.dropped, 1)
+					log.Printf("Too many pending handshakes - closing user connection at %v", c.RemoteAddr())
+					c.Close()
+					continue
+				}
+				tc, ok := uh.tcpConns.track(c)
+				if !ok {
+					<-uh.pending
+					c.Close()
+					continue
+				}
+				go func() {
+					// The user is registered by handleUser. The pending slot is released once the
+					// handshake is over, which is signaled over the channel.
+					defer func() { <-uh.pending }()
+					<-uh.handleUser(tc)
+				}()
 			case <-quit:
 				log.Println("Stopping user handler")
+				uh.tcpConns.closeAll()
+				uh.tcpConns.wait()
 				return
 			}
 		}
@@ -1,38 +1,82 @@
 package userclients
 
 import (
+	"bufio"
+	"errors"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/johananl/follower-maze/memnet"
 )
 
-var uh = NewUserHandler()
+// userEvents reports the users of a user handler as they connect and disconnect. Its channels are
+// fed by hooks, so tests can wait for users to be registered and unregistered without polling.
+type userEvents struct {
+	connected    chan int
+	disconnected chan int
+}
+
+// watchUsers sets hooks on uh which report its users as they connect and disconnect.
+func watchUsers(uh *UserHandler) *userEvents {
+	e := &userEvents{connected: make(chan int, 100), disconnected: make(chan int, 100)}
+	uh.SetHooks(Hooks{
+		OnConnect:    func(id int) { e.connected <- id },
+		OnDisconnect: func(id int) { e.disconnected <- id },
+	})
+
+	return e
+}
+
+// awaitUsers waits for all of the given user IDs to be reported over ch, in any order.
+func awaitUsers(t *testing.T, ch <-chan int, ids ...int) {
+	pending := make(map[int]bool)
+	for _, id := range ids {
+		pending[id] = true
+	}
+	timeout := time.After(5 * time.Second)
+	for len(pending) > 0 {
+		select {
+		case id := <-ch:
+			delete(pending, id)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for users %v", ids)
+		}
+	}
+}
 
 func TestRegisterUser(t *testing.T) {
+	uh := NewUserHandler()
 	// Fake connection for testing
 	conn, _ := net.Pipe()
 	defer conn.Close()
-	u := User{100, conn}
+	u := User{id: 100, connection: conn}
 
 	uh.registerUser(u)
 
-	if uh.Users[100] != conn {
+	if u, _ := uh.users.get(100); u.connection != conn {
 		t.Fatalf("User not registered")
 	}
 }
 
-// TestAcceptConnections ensures that acceptConnections successfully returns net.Conn structs for TCP
+// TestAcceptConnections ensures that acceptConnections successfully returns net.Conn structs for
 // connections received from a listener.
 func TestAcceptConnections(t *testing.T) {
-	l, err := net.Listen("tcp", "localhost:9099")
+	n := memnet.NewNetwork()
+	l, err := n.Listen("tcp", "localhost:9099")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer l.Close()
 
-	conns, stop := uh.acceptConnections(l)
+	conns, stop := NewUserHandler().acceptConnections(l)
 	defer close(stop)
 
-	cConn, err := net.Dial("tcp", "localhost:9099")
+	cConn, err := n.Dial("localhost:9099")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,11 +85,10 @@ func TestAcceptConnections(t *testing.T) {
 	sConn := <-conns
 	defer sConn.Close()
 
-	if cConn.LocalAddr().String() != sConn.RemoteAddr().String() {
-		t.Fatalf(
-			"Invalid connection received: %v != %v",
-			cConn.LocalAddr().String(), sConn.RemoteAddr().String(),
-		)
+	go cConn.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := sConn.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatal("Invalid connection received")
 	}
 }
 
@@ -59,7 +102,7 @@ func TestHandleUser(t *testing.T) {
 		server.Close()
 	}()
 
-	ch := uh.handleUser(server)
+	ch := NewUserHandler().handleUser(server)
 
 	// Send a user ID over the connection.
 	client.Write([]byte("123\n"))
@@ -73,4 +116,187 @@ func TestHandleUser(t *testing.T) {
 	}
 }
 
+// TestReidentify ensures that an identified client may switch to another user, and that any other
+// line which isn't a command closes the connection instead of blocking handleUser.
+func TestReidentify(t *testing.T) {
+	uh := NewUserHandler()
+	client, server := net.Pipe()
+	defer client.Close()
+	br := bufio.NewReader(client)
+
+	ch := uh.handleUser(server)
+	client.Write([]byte("1\n"))
+	if u := <-ch; u.id != 1 {
+		t.Fatalf("Invalid user ID: got %v, want 1", u.id)
+	}
+
+	go client.Write([]byte("?IDENTIFY 2 types=P\n"))
+	if got, _ := br.ReadString('\n'); got != "?IDENTIFY|2\n" {
+		t.Fatalf("Invalid response: got %q", got)
+	}
+	if _, ok := uh.users.get(1); ok {
+		t.Fatal("Previous user still registered")
+	}
+	if u, ok := uh.users.get(2); !ok || u.connection != server || !u.filter.allows("5|P|1|2\n") || u.filter.allows("5|B\n") {
+		t.Fatal("Connection not moved to the new user")
+	}
+
+	go client.Write([]byte("?IDENTIFY x y\n"))
+	if got, _ := br.ReadString('\n'); got != "?ERROR|invalid handshake option y\n" {
+		t.Fatalf("Invalid response: got %q", got)
+	}
+
+	go client.Write([]byte("3\n"))
+	if got, _ := br.ReadString('\n'); !strings.HasPrefix(got, "?ERROR|") {
+		t.Fatalf("Invalid response: got %q", got)
+	}
+	// The user is unregistered before the connection is closed.
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Fatal("Connection not closed after a protocol error")
+	}
+	if _, ok := uh.users.get(2); ok {
+		t.Fatal("User not unregistered after a protocol error")
+	}
+	if _, ok := uh.users.get(3); ok {
+		t.Fatal("User registered by an extra line")
+	}
+}
+
+// brokenConn is a connection which returns handshake on the first read and then fails every read
+// with the same error, like a TLS connection which received an invalid record.
+type brokenConn struct {
+	net.Conn
+	handshake string
+	reads     int32
+}
+
+func (c *brokenConn) Read(p []byte) (int, error) {
+	if atomic.AddInt32(&c.reads, 1) == 1 {
+		return copy(p, c.handshake), nil
+	}
+	return 0, errors.New("local error: tls: bad record MAC")
+}
+
+func (c *brokenConn) Write(p []byte) (int, error)       { return len(p), nil }
+func (c *brokenConn) Close() error                      { return nil }
+func (c *brokenConn) RemoteAddr() net.Addr              { return memnet.Addr("broken") }
+func (c *brokenConn) SetReadDeadline(t time.Time) error { return nil }
+
+// awaitClosed waits for the channel returned by handleUser to be closed.
+func awaitClosed(t *testing.T, ch <-chan User) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the connection to be closed")
+		}
+	}
+}
+
+// TestHandleUserReadError ensures that a connection is closed, rather than read again, once a read
+// fails with an error which isn't a timeout.
+func TestHandleUserReadError(t *testing.T) {
+	h := NewUserHandler()
+	c := &brokenConn{handshake: "123\n"}
+
+	awaitClosed(t, h.handleUser(c))
+
+	if reads := atomic.LoadInt32(&c.reads); reads != 2 {
+		t.Fatalf("Invalid number of reads: got %d, want 2", reads)
+	}
+	if ids := h.ConnectedUsers(); len(ids) != 0 {
+		t.Fatalf("User not unregistered: %v", ids)
+	}
+}
+
+// discardConn is a connection which discards everything written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// TestConcurrentAccess stresses the user handler the way the event path uses it: users connect and
+// disconnect, follow and unfollow each other and get broadcasts and status updates, all
+// concurrently. Run it with -race to detect unsafe access.
+func TestConcurrentAccess(t *testing.T) {
+	uh := NewUserHandler()
+	const (
+		users      = 50
+		iterations = 200
+	)
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				fn(i)
+			}
+		}()
+	}
+
+	// Connects and disconnects
+	run(func(i int) {
+		u := User{id: i % users, connection: discardConn{}}
+		uh.registerUser(u)
+		if i%3 == 0 {
+			uh.unregisterUser(u)
+		}
+	})
+	// Follows and unfollows
+	run(func(i int) {
+		uh.Follow(i%users, (i+1)%users)
+		if i%2 == 0 {
+			uh.Unfollow((i+7)%users, (i+8)%users)
+		}
+	})
+	// Broadcasts
+	run(func(i int) {
+		uh.ForEachConnected(func(id int) {
+			uh.NotifyUser(id, strconv.Itoa(i)+"|B\n")
+		})
+	})
+	// Status updates
+	run(func(i int) {
+		for _, id := range uh.FollowersSnapshot(i % users) {
+			uh.NotifyUser(id, strconv.Itoa(i)+"|S|"+strconv.Itoa(i%users)+"\n")
+		}
+	})
+
+	wg.Wait()
+}
+
 // TODO Cover the rest of the important functions in the package.
+
+// TestRunListenError ensures that listen errors are reported instead of exiting, and that the
+// handler may still be stopped.
+func TestRunListenError(t *testing.T) {
+	uh := NewUserHandler()
+	listenErr := errors.New("listen error")
+	uh.SetListenFunc(func(network, address string) (net.Listener, error) {
+		return nil, listenErr
+	})
+	stop := uh.Run()
+	stopHTTP := uh.RunHTTP()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-uh.Errors():
+			if err != listenErr {
+				t.Fatalf("Invalid error: got %v, want %v", err, listenErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Listen error not reported")
+		}
+	}
+
+	stopHTTP <- true
+	stop <- true
+	uh.Wait()
+}
@@ -0,0 +1,355 @@
+package userclients
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink receives notifications which couldn't be delivered since their user wasn't connected.
+// Undelivered is called synchronously while the event is processed, so it should return quickly.
+type Sink interface {
+	Undelivered(id int, message string)
+}
+
+// Webhook defaults
+const (
+	defaultWebhookBatchSize      = 100
+	defaultWebhookFlushInterval  = time.Second
+	defaultWebhookQueueSize      = 10000
+	defaultWebhookMaxRetries     = 5
+	defaultWebhookInitialBackoff = 100 * time.Millisecond
+	defaultWebhookMaxBackoff     = 10 * time.Second
+	defaultWebhookTimeout        = 10 * time.Second
+	defaultWebhookDrainTimeout   = 5 * time.Second
+)
+
+// webhookDropLogInterval is the shortest time between logs of notifications dropped since the queue
+// was full, so that a sink which can't keep up doesn't flood the log.
+const webhookDropLogInterval = 10 * time.Second
+
+// WebhookSignatureHeader is the header holding the signature of a webhook request's body. The
+// signature is "sha256=" followed by the hex-encoded HMAC-SHA256 of the body, computed with the
+// webhook's secret.
+const WebhookSignatureHeader = "X-Follower-Maze-Signature"
+
+// WebhookConfig configures a WebhookSink. Fields other than URL and Secret are optional and fall
+// back to defaults when zero, or nil for MaxRetries.
+type WebhookConfig struct {
+	// URL is the endpoint which batches of notifications are POSTed to.
+	URL string
+	// Secret is the key used for signing request bodies.
+	Secret []byte
+	// BatchSize is the largest number of notifications sent in a single request.
+	BatchSize int
+	// FlushInterval is the longest time a notification waits for its batch to fill up.
+	FlushInterval time.Duration
+	// QueueSize is the number of notifications which may wait to be sent. Notifications which
+	// don't fit in the queue are dropped.
+	QueueSize int
+	// MaxRetries is the number of times a failed request is retried before its batch is dropped. A
+	// pointer to zero disables retries.
+	MaxRetries *int
+	// InitialBackoff is the time waited before the first retry. It doubles with every retry up to
+	// MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest time waited between retries.
+	MaxBackoff time.Duration
+	// Client is the HTTP client used for sending requests.
+	Client *http.Client
+	// DrainTimeout is the longest time queued notifications are sent for once the sink has been
+	// stopped. Notifications which aren't sent by then, including those of a request being
+	// retried, count as failed.
+	DrainTimeout time.Duration
+}
+
+// WebhookStats holds counters of the notifications handled by a WebhookSink since it was created.
+type WebhookStats struct {
+	// Sent counts notifications accepted by the endpoint.
+	Sent int64
+	// Failed counts notifications of batches which the endpoint rejected or which couldn't be sent
+	// within the allowed retries.
+	Failed int64
+	// Dropped counts notifications which were dropped since the queue was full.
+	Dropped int64
+}
+
+// webhookNotification is the JSON representation of an undelivered notification.
+type webhookNotification struct {
+	User         int    `json:"user"`
+	Notification string `json:"notification"`
+}
+
+// WebhookSink is a Sink which POSTs undelivered notifications to an HTTP endpoint, e.g. a push
+// notification service. Notifications are queued and sent in batches as a JSON array of objects
+// such as {"user": 2932, "notification": "666|F|60|2932"}. Every request is signed with
+// WebhookSignatureHeader. Requests which fail with a network error, a 5xx status or a 429 status are
+// retried with exponential backoff. Notifications are only sent while the sink is running.
+type WebhookSink struct {
+	config     WebhookConfig
+	maxRetries int
+	queue      chan webhookNotification
+
+	running sync.WaitGroup
+
+	sent    int64
+	failed  int64
+	dropped int64
+	// unloggedDrops counts drops since lastDropLog, the time in nanoseconds at which drops were
+	// last logged.
+	unloggedDrops int64
+	lastDropLog   int64
+}
+
+// NewWebhookSink constructs a new WebhookSink and returns a pointer to it. It returns an error if
+// no URL or secret was configured or if MaxRetries is negative.
+func NewWebhookSink(config WebhookConfig) (*WebhookSink, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook URL is required")
+	}
+	if len(config.Secret) == 0 {
+		return nil, errors.New("webhook secret is required")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultWebhookBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultWebhookFlushInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultWebhookQueueSize
+	}
+	maxRetries := defaultWebhookMaxRetries
+	if config.MaxRetries != nil {
+		if *config.MaxRetries < 0 {
+			return nil, errors.New("webhook max retries must not be negative")
+		}
+		maxRetries = *config.MaxRetries
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = defaultWebhookInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = defaultWebhookDrainTimeout
+	}
+
+	return &WebhookSink{
+		config:     config,
+		maxRetries: maxRetries,
+		queue:      make(chan webhookNotification, config.QueueSize),
+	}, nil
+}
+
+// Undelivered queues a notification to be sent. It never blocks: the notification is dropped if the
+// queue is full.
+func (s *WebhookSink) Undelivered(id int, message string) {
+	select {
+	case s.queue <- webhookNotification{id, strings.TrimSuffix(message, "\n")}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		s.logDrop()
+	}
+}
+
+// logDrop counts a dropped notification and logs the drops counted so far, unless they were logged
+// within webhookDropLogInterval.
+func (s *WebhookSink) logDrop() {
+	atomic.AddInt64(&s.unloggedDrops, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastDropLog)
+	if now-last < int64(webhookDropLogInterval) || !atomic.CompareAndSwapInt64(&s.lastDropLog, last, now) {
+		return
+	}
+	log.Printf("Webhook queue is full - dropped %d notifications", atomic.SwapInt64(&s.unloggedDrops, 0))
+}
+
+// Stats returns a snapshot of the sink's counters.
+func (s *WebhookSink) Stats() WebhookStats {
+	return WebhookStats{
+		Sent:    atomic.LoadInt64(&s.sent),
+		Failed:  atomic.LoadInt64(&s.failed),
+		Dropped: atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// sign returns the signature of a request body.
+func (s *WebhookSink) sign(body []byte) string {
+	h := hmac.New(sha256.New, s.config.Secret)
+	h.Write(body)
+
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// backoff returns the time to wait before the given retry, starting from 1.
+func (s *WebhookSink) backoff(retry int) time.Duration {
+	d := s.config.InitialBackoff
+	for i := 1; i < retry && d < s.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.config.MaxBackoff {
+		d = s.config.MaxBackoff
+	}
+
+	return d
+}
+
+// post sends a single request and reports whether it succeeded and, if not, whether it may be
+// retried.
+func (s *WebhookSink) post(ctx context.Context, body []byte) (ok, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, s.sign(body))
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return false, ctx.Err() == nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return false, true, errors.New("endpoint responded with status " + strconv.Itoa(resp.StatusCode))
+	default:
+		return false, false, errors.New("endpoint responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+}
+
+// send sends a batch of notifications, retrying with exponential backoff if needed. The batch fails
+// once ctx is done.
+func (s *WebhookSink) send(ctx context.Context, batch []webhookNotification) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		atomic.AddInt64(&s.failed, int64(len(batch)))
+		log.Println("Error encoding webhook batch:", err.Error())
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			t := time.NewTimer(s.backoff(attempt))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				atomic.AddInt64(&s.failed, int64(len(batch)))
+				log.Printf("Dropping webhook batch of %d notifications: sink stopped while retrying", len(batch))
+				return
+			}
+		}
+		ok, retry, err := s.post(ctx, body)
+		if ok {
+			atomic.AddInt64(&s.sent, int64(len(batch)))
+			return
+		}
+		if !retry || attempt == s.maxRetries {
+			atomic.AddInt64(&s.failed, int64(len(batch)))
+			log.Printf("Dropping webhook batch of %d notifications: %s", len(batch), err.Error())
+			return
+		}
+		log.Println("Error sending webhook batch - retrying:", err.Error())
+	}
+}
+
+// Run starts sending queued notifications. A batch is sent once it is full or once its oldest
+// notification has waited for the flush interval. Once stopped, notifications which are still
+// queued are sent before the sink exits, for at most the drain timeout.
+func (s *WebhookSink) Run() chan<- bool {
+	quit := make(chan bool)
+	// stopping is closed once the sink has been signaled, and ctx is canceled once the drain
+	// timeout has passed since. Signaling never waits for a request in progress.
+	stopping := make(chan struct{})
+	finished := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.running.Add(2)
+	go func() {
+		defer s.running.Done()
+		defer cancel()
+
+		<-quit
+		close(stopping)
+		t := time.NewTimer(s.config.DrainTimeout)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			log.Println("Webhook sink drain timed out")
+		case <-finished:
+		}
+	}()
+
+	go func() {
+		defer s.running.Done()
+		defer close(finished)
+
+		ticker := time.NewTicker(s.config.FlushInterval)
+		defer ticker.Stop()
+
+		var batch []webhookNotification
+		for {
+			select {
+			case n := <-s.queue:
+				if len(batch) == 0 {
+					// Restart the flush interval for the new batch.
+					ticker.Reset(s.config.FlushInterval)
+				}
+				batch = append(batch, n)
+				if len(batch) >= s.config.BatchSize {
+					s.send(ctx, batch)
+					batch = nil
+				}
+			case <-ticker.C:
+				if len(batch) > 0 {
+					s.send(ctx, batch)
+					batch = nil
+				}
+			case <-stopping:
+				log.Println("Stopping webhook sink")
+				for {
+					select {
+					case n := <-s.queue:
+						batch = append(batch, n)
+						if len(batch) >= s.config.BatchSize {
+							s.send(ctx, batch)
+							batch = nil
+						}
+					default:
+						if len(batch) > 0 {
+							s.send(ctx, batch)
+						}
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return quit
+}
+
+// Wait blocks until the sink has stopped and the notifications queued when Run was signaled have
+// been sent or the drain timeout has passed.
+func (s *WebhookSink) Wait() {
+	s.running.Wait()
+}
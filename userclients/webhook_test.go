@@ -0,0 +1,304 @@
+package userclients
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var webhookSecret = []byte("secret")
+
+// webhookEndpoint is a test endpoint which verifies signatures and records the batches it receives.
+// Its first failures requests are answered with failStatus.
+type webhookEndpoint struct {
+	lock       sync.Mutex
+	requests   int
+	batches    [][]webhookNotification
+	failures   int
+	failStatus int
+	received   chan struct{}
+}
+
+func newWebhookEndpoint(failures, failStatus int) *webhookEndpoint {
+	return &webhookEndpoint{failures: failures, failStatus: failStatus, received: make(chan struct{}, 100)}
+}
+
+func (e *webhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	mac := hmac.New(sha256.New, webhookSecret)
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(want)) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.requests++
+	if e.requests <= e.failures {
+		w.WriteHeader(e.failStatus)
+		e.received <- struct{}{}
+		return
+	}
+	var batch []webhookNotification
+	json.Unmarshal(body, &batch)
+	e.batches = append(e.batches, batch)
+	e.received <- struct{}{}
+}
+
+// await waits for the endpoint to receive n requests.
+func (e *webhookEndpoint) await(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-e.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for webhook request %d", i+1)
+		}
+	}
+}
+
+// stopSink stops a running sink and checks its counters once it has stopped.
+func stopSink(t *testing.T, s *WebhookSink, stop chan<- bool, want WebhookStats) {
+	stop <- true
+	s.Wait()
+	if got := s.Stats(); got != want {
+		t.Fatalf("Invalid webhook stats: got %+v, want %+v", got, want)
+	}
+}
+
+// TestWebhookSink ensures that undelivered notifications are sent in signed batches, which are sent
+// once full or once the flush interval has passed.
+func TestWebhookSink(t *testing.T) {
+	e := newWebhookEndpoint(0, 0)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	s, err := NewWebhookSink(WebhookConfig{
+		URL:           srv.URL,
+		Secret:        webhookSecret,
+		BatchSize:     2,
+		FlushInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := s.Run()
+
+	s.Undelivered(1, "1|F|2|1\n")
+	s.Undelivered(3, "2|P|1|3\n")
+	s.Undelivered(1, "3|F|4|1\n")
+	e.await(t, 2)
+
+	want := [][]webhookNotification{
+		{{1, "1|F|2|1"}, {3, "2|P|1|3"}},
+		{{1, "3|F|4|1"}},
+	}
+	if !reflect.DeepEqual(e.batches, want) {
+		t.Fatalf("Invalid batches: got %v, want %v", e.batches, want)
+	}
+	stopSink(t, s, stop, WebhookStats{Sent: 3})
+}
+
+// TestWebhookRetry ensures that requests which fail with a server error are retried and that
+// requests which are rejected aren't.
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		failStatus int
+		requests   int
+		want       WebhookStats
+	}{
+		{http.StatusServiceUnavailable, 3, WebhookStats{Sent: 1}},
+		{http.StatusTooManyRequests, 3, WebhookStats{Sent: 1}},
+		{http.StatusBadRequest, 1, WebhookStats{Failed: 1}},
+	}
+	for _, tt := range tests {
+		e := newWebhookEndpoint(2, tt.failStatus)
+		srv := httptest.NewServer(e)
+
+		s, err := NewWebhookSink(WebhookConfig{
+			URL:            srv.URL,
+			Secret:         webhookSecret,
+			BatchSize:      1,
+			InitialBackoff: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := s.Run()
+		s.Undelivered(1, "1|F|2|1\n")
+		e.await(t, tt.requests)
+		stopSink(t, s, stop, tt.want)
+		srv.Close()
+
+		if e.requests != tt.requests {
+			t.Fatalf("Invalid number of requests on status %d: got %d, want %d", tt.failStatus, e.requests, tt.requests)
+		}
+	}
+}
+
+// TestWebhookGiveUp ensures that a batch is dropped once it has been retried MaxRetries times, and
+// right away if retries are disabled.
+func TestWebhookGiveUp(t *testing.T) {
+	for _, retries := range []int{2, 0} {
+		e := newWebhookEndpoint(100, http.StatusInternalServerError)
+		srv := httptest.NewServer(e)
+
+		retries := retries
+		s, err := NewWebhookSink(WebhookConfig{
+			URL:            srv.URL,
+			Secret:         webhookSecret,
+			BatchSize:      1,
+			MaxRetries:     &retries,
+			InitialBackoff: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := s.Run()
+
+		s.Undelivered(1, "1|F|2|1\n")
+		e.await(t, retries+1)
+		stopSink(t, s, stop, WebhookStats{Failed: 1})
+		srv.Close()
+
+		if e.requests != retries+1 {
+			t.Fatalf("Invalid number of requests with %d retries: got %d, want %d", retries, e.requests, retries+1)
+		}
+	}
+}
+
+// TestWebhookStopDown ensures that stopping a sink whose endpoint is down doesn't wait for retries
+// beyond the drain timeout, and that the notifications which weren't sent count as failed.
+func TestWebhookStopDown(t *testing.T) {
+	e := newWebhookEndpoint(100, http.StatusServiceUnavailable)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	s, err := NewWebhookSink(WebhookConfig{
+		URL:            srv.URL,
+		Secret:         webhookSecret,
+		BatchSize:      1,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+		DrainTimeout:   10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := s.Run()
+	for i := 0; i < 3; i++ {
+		s.Undelivered(1, "1|F|2|1\n")
+	}
+	e.await(t, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop <- true
+		s.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sink didn't stop within the drain timeout")
+	}
+	if got := s.Stats(); got != (WebhookStats{Failed: 3}) {
+		t.Fatalf("Invalid webhook stats: got %+v, want %+v", got, WebhookStats{Failed: 3})
+	}
+}
+
+// TestWebhookDropLog ensures that notifications dropped since the queue is full are all counted but
+// only logged once per interval.
+func TestWebhookDropLog(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	s, err := NewWebhookSink(WebhookConfig{URL: "http://localhost", Secret: webhookSecret, QueueSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.Undelivered(1, "1|F|2|1\n")
+	}
+
+	if got := s.Stats(); got != (WebhookStats{Dropped: 4}) {
+		t.Fatalf("Invalid webhook stats: got %+v", got)
+	}
+	if logs := strings.Count(buf.String(), "Webhook queue is full"); logs != 1 {
+		t.Fatalf("Invalid number of drop logs: got %d, want 1", logs)
+	}
+}
+
+// TestWebhookBackoff ensures that the backoff doubles with every retry up to the maximum.
+func TestWebhookBackoff(t *testing.T) {
+	s, err := NewWebhookSink(WebhookConfig{
+		URL:            "http://localhost",
+		Secret:         webhookSecret,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := s.backoff(i + 1); got != w*time.Millisecond {
+			t.Fatalf("Invalid backoff of retry %d: got %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+
+	if s.maxRetries != defaultWebhookMaxRetries {
+		t.Fatalf("Invalid default retries: got %d, want %d", s.maxRetries, defaultWebhookMaxRetries)
+	}
+
+	if _, err := NewWebhookSink(WebhookConfig{URL: "http://localhost"}); err == nil {
+		t.Fatal("Expected an error creating a webhook sink without a secret")
+	}
+	negative := -1
+	if _, err := NewWebhookSink(WebhookConfig{URL: "http://localhost", Secret: webhookSecret, MaxRetries: &negative}); err == nil {
+		t.Fatal("Expected an error creating a webhook sink with negative retries")
+	}
+}
+
+// recordingSink is a Sink which records the notifications passed to it.
+type recordingSink struct {
+	notifications []webhookNotification
+}
+
+func (s *recordingSink) Undelivered(id int, message string) {
+	s.notifications = append(s.notifications, webhookNotification{id, message})
+}
+
+// TestUndeliveredSink ensures that only notifications of users who aren't connected are passed to
+// the undelivered sink.
+func TestUndeliveredSink(t *testing.T) {
+	h := NewUserHandler()
+	sink := &recordingSink{}
+	h.SetUndeliveredSink(sink)
+	h.registerUser(User{1, discardConn{}, nil})
+	h.registerUser(User{2, discardConn{}, typeFilter{"P": true}})
+
+	h.NotifyUser(1, "1|F|3|1\n")
+	h.NotifyUser(2, "2|F|3|2\n")
+	h.NotifyUser(3, "3|P|1|3\n")
+
+	want := []webhookNotification{{3, "3|P|1|3\n"}}
+	if !reflect.DeepEqual(sink.notifications, want) {
+		t.Fatalf("Invalid undelivered notifications: got %v, want %v", sink.notifications, want)
+	}
+}
@@ -0,0 +1,361 @@
+package userclients
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// webSocketGUID is the magic value defined in RFC 6455 which is used for computing the
+// Sec-WebSocket-Accept header during the opening handshake.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxFramePayload limits the size of frames accepted from WebSocket clients. User clients only
+// send their credentials and short commands, so anything larger than this is considered a protocol
+// violation.
+const maxFramePayload = 4096
+
+// WebSocket frame opcodes (RFC 6455, section 5.2).
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// maxControlPayload is the largest payload allowed in control frames (RFC 6455, section 5.5).
+const maxControlPayload = 125
+
+// WebSocket close status codes (RFC 6455, section 7.4.1).
+const (
+	closeProtocolError uint16 = 1002
+	closeTooLarge      uint16 = 1009
+)
+
+var (
+	errFrameTooLarge   = errors.New("WebSocket frame too large")
+	errReservedBits    = errors.New("received a WebSocket frame with reserved bits set")
+	errFragmented      = errors.New("received a fragmented WebSocket message")
+	errControlTooLarge = errors.New("received an oversized WebSocket control frame")
+	errUnmasked        = errors.New("received an unmasked WebSocket frame")
+)
+
+// wsConn wraps a hijacked HTTP connection and implements net.Conn on top of the WebSocket framing
+// protocol. Every Write sends a single text frame and every Read returns data from text or binary
+// frames, which allows WebSocket clients to be stored in the Users registry alongside TCP clients
+// and be notified by NotifyUser without any special handling.
+type wsConn struct {
+	net.Conn
+	br        *bufio.Reader
+	wLock     sync.Mutex
+	closeSent bool   // Whether a close frame was sent, after which nothing else may be sent
+	pending   []byte // Unread payload of the last data frame
+}
+
+// Read reads payload data from incoming data frames. Control frames are handled transparently:
+// pings are answered with pongs and a close frame results in io.EOF. Frames which violate the
+// protocol, including fragmented messages which aren't supported, are answered with a close frame
+// and result in an error.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case opText, opBinary:
+			c.pending = payload
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, err
+			}
+		case opPong:
+			// Unsolicited pongs are allowed and should be ignored.
+		case opClose:
+			c.writeClose(nil)
+			return 0, io.EOF
+		default:
+			return 0, c.fail(closeProtocolError, errors.New("unknown WebSocket opcode "+strconv.Itoa(int(opcode))))
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Write sends p to the client as a single text frame.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opText, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close sends a close frame to the client, unless one was already sent, and closes the underlying
+// connection.
+func (c *wsConn) Close() error {
+	c.writeClose(nil)
+	return c.Conn.Close()
+}
+
+// fail sends a close frame with the given status code to the client and returns err.
+func (c *wsConn) fail(code uint16, err error) error {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.writeClose(payload[:])
+
+	return err
+}
+
+// readFrame reads a single frame from the client and returns its opcode and unmasked payload.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	rsv := header[0] & 0x70
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// No extensions are negotiated, so the reserved bits must be clear (RFC 6455, section 5.2).
+	if rsv != 0 {
+		return 0, nil, c.fail(closeProtocolError, errReservedBits)
+	}
+	// Messages must fit in a single frame: initial fragments and continuation frames are rejected.
+	if !fin || opcode == opContinuation {
+		return 0, nil, c.fail(closeProtocolError, errFragmented)
+	}
+	if opcode&0x08 != 0 && length > maxControlPayload {
+		return 0, nil, c.fail(closeProtocolError, errControlTooLarge)
+	}
+	if length > maxFramePayload {
+		return 0, nil, c.fail(closeTooLarge, errFrameTooLarge)
+	}
+
+	// Frames sent by clients must always be masked (RFC 6455, section 5.1).
+	if !masked {
+		return 0, nil, c.fail(closeProtocolError, errUnmasked)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return opcode, payload, nil
+}
+
+// writeClose sends a close frame with the given payload to the client, unless one was already
+// sent.
+func (c *wsConn) writeClose(payload []byte) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	return c.write(opClose, payload)
+}
+
+// writeFrame sends a single, final, unmasked frame to the client. Writes are serialized since
+// notifications and control frames may be sent from different goroutines.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if c.closeSent {
+		return errors.New("WebSocket connection closing")
+	}
+
+	return c.write(opcode, payload)
+}
+
+// write sends a single frame. The write lock must be held.
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if _, err := c.Conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// webSocketAccept computes the value of the Sec-WebSocket-Accept header for the given key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether a comma-separated header contains the given token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upgradeWebSocket performs the server side of the WebSocket opening handshake and returns the
+// resulting connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("invalid method " + r.Method)
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, br: brw.Reader}, nil
+}
+
+// handleWebSocket upgrades an HTTP request to a WebSocket connection and registers the user whose
+// credentials, optionally followed by a subscription filter, are sent in the first text frame. The
+// user stays registered until the client disconnects. Subsequent frames may hold commands, which are
+// answered with a text frame each.
+func (uh *UserHandler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	wc, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Println("WebSocket handshake failed:", err.Error())
+		return
+	}
+	conn, ok := uh.httpConns.track(wc)
+	if !ok {
+		log.Printf("User handler stopping - closing WebSocket user connection at %v", wc.RemoteAddr())
+		wc.Close()
+		return
+	}
+	log.Printf("Accepted a WebSocket user connection from %v", conn.RemoteAddr())
+
+	// Close connection when done reading.
+	defer func() {
+		log.Printf("Closing WebSocket user connection at %v\n", conn.RemoteAddr())
+		conn.Close()
+	}()
+
+	var userID int
+	buf := make([]byte, maxFramePayload)
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Println("Error reading user ID from WebSocket:", err.Error())
+		return
+	}
+
+	credentials, filter, err := parseHandshake(string(buf[:n]))
+	if err == nil {
+		userID, err = uh.authenticator.Authenticate(credentials)
+	}
+	if err != nil {
+		log.Printf("Rejecting WebSocket user connection at %v: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	u := User{userID, conn, filter}
+	uh.registerUser(u)
+	defer uh.unregisterUser(u)
+
+	// Keep reading until the client goes away so that control frames and commands are handled.
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading from WebSocket:", err.Error())
+			}
+			return
+		}
+
+		if message := string(buf[:n]); isCommand(message) {
+			conn.Write([]byte(uh.handleCommand(userID, message)))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package userclients
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// dialWebSocket performs a client-side WebSocket handshake against the given test server.
+func dialWebSocket(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	conn.Write([]byte("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Invalid handshake status: got %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// Value taken from the example in RFC 6455, section 1.3.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Invalid Sec-WebSocket-Accept: got %v", got)
+	}
+
+	return conn, br
+}
+
+// writeMaskedFrame sends a masked text frame the way a browser would.
+func writeMaskedFrame(conn net.Conn, payload string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opText, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+// TestWebSocketNotify ensures that a WebSocket client is registered using the ID sent in its
+// first frame and receives notifications sent with NotifyUser.
+func TestWebSocketNotify(t *testing.T) {
+	uh := NewUserHandler()
+	users := watchUsers(uh)
+	srv := httptest.NewServer(uh.newHTTPHandler())
+	defer srv.Close()
+
+	conn, br := dialWebSocket(t, srv)
+	defer conn.Close()
+
+	writeMaskedFrame(conn, "4321")
+
+	awaitUsers(t, users.connected, 4321)
+
+	uh.NotifyUser(4321, "1|B\n")
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x80|opText {
+		t.Fatalf("Invalid frame header: got %#x, want %#x", header[0], 0x80|opText)
+	}
+	payload := make([]byte, header[1])
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "1|B\n" {
+		t.Fatalf("Invalid notification: got %q, want %q", payload, "1|B\n")
+	}
+}
+
+// rawFrame builds a masked frame with the given first header byte, which holds the FIN and RSV
+// bits and the opcode.
+func rawFrame(first byte, payload []byte) []byte {
+	frame := []byte{first}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+
+	return frame
+}
+
+// TestWebSocketClose ensures that frames which end the connection are answered with a single close
+// frame, including once the connection is closed, and that protocol violations are answered with
+// a protocol error.
+func TestWebSocketClose(t *testing.T) {
+	protocolError := []byte{0x80 | opClose, 2, 0x03, 0xEA}
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []byte
+	}{
+		{"close", rawFrame(0x80|opClose, nil), []byte{0x80 | opClose, 0}},
+		{"fragment", rawFrame(opText, []byte("1")), protocolError},
+		{"continuation", rawFrame(0x80|opContinuation, []byte("1")), protocolError},
+		{"reserved bits", rawFrame(0x80|0x40|opText, []byte("1")), protocolError},
+		{"oversized ping", rawFrame(0x80|opPing, make([]byte, 126)), protocolError},
+		{"unknown opcode", rawFrame(0x80|0x3, nil), protocolError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			wc := &wsConn{Conn: server, br: bufio.NewReader(server)}
+			go func() {
+				wc.Read(make([]byte, 1))
+				wc.Close()
+			}()
+			go client.Write(tc.frame)
+
+			// Everything the server sends is read until it closes the connection.
+			got, _ := ioutil.ReadAll(client)
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("Invalid frames sent: got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}